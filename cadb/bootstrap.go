@@ -0,0 +1,213 @@
+package cadb
+
+import (
+	"database/sql"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// The device id under which bootstrap certificates are recorded.
+const BootstrapId = "bootstrap"
+
+// The device ids under which the server records the certificates it
+// issues for itself.
+const (
+	ServerId     = "server"
+	OCSPSignerId = "ocsp-signer"
+)
+
+// ClassRevoked is an error that indicates a bootstrap class has been
+// revoked, and may no longer be used.
+var ClassRevoked = errors.New("Bootstrap Class Revoked")
+
+// UnknownClass is an error that indicates no bootstrap class has the
+// given name.
+var UnknownClass = errors.New("Unknown Bootstrap Class")
+
+// EnrollmentLimit is an error that indicates a bootstrap class has
+// made all of the enrollments it is permitted.
+var EnrollmentLimit = errors.New("Enrollment Limit Reached")
+
+// A BootstrapClass is a class of devices, such as a product line,
+// factory or batch, that enroll with a shared bootstrap certificate,
+// along with the policy for their enrollments.
+type BootstrapClass struct {
+	Name string
+
+	// The certificate profile devices of this class enroll under,
+	// or "" to use the profile mapping.
+	Profile string
+
+	// The number of enrollments permitted, or 0 for no limit, and
+	// the number made so far.
+	MaxEnroll   int
+	Enrollments int
+
+	// No enrollments are accepted after this time.
+	Expiry time.Time
+
+	Revoked bool
+}
+
+// SetBootstrapClass adds a bootstrap class, or updates the policy of
+// an existing one.  The count of enrollments is kept.  Returns
+// ClassRevoked if the class has been revoked.
+func (conn *Conn) SetBootstrapClass(class *BootstrapClass) error {
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var revoked bool
+	err = tx.QueryRow(`SELECT revoked FROM bootstrap WHERE class = ?`,
+		class.Name).Scan(&revoked)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`INSERT INTO bootstrap (class, profile, maxenroll, enrollments, expiry, revoked)
+			VALUES (?, ?, ?, 0, ?, 0)`,
+			class.Name, nullString(class.Profile), nullLimit(class.MaxEnroll), class.Expiry)
+	case err != nil:
+	case revoked:
+		err = ClassRevoked
+	default:
+		_, err = tx.Exec(`UPDATE bootstrap
+			SET profile = ?, maxenroll = ?, expiry = ?
+			WHERE class = ?`,
+			nullString(class.Profile), nullLimit(class.MaxEnroll), class.Expiry, class.Name)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	return err
+}
+
+// GetBootstrapClass returns the bootstrap class with the given name,
+// or nil if there is no such class.
+func (conn *Conn) GetBootstrapClass(name string) (*BootstrapClass, error) {
+	row := conn.db.QueryRow(`SELECT class, profile, maxenroll, enrollments, expiry, revoked
+		FROM bootstrap WHERE class = ?`, name)
+	class, err := scanBootstrapClass(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return class, err
+}
+
+// BootstrapClasses returns all of the bootstrap classes.
+func (conn *Conn) BootstrapClasses() ([]*BootstrapClass, error) {
+	rows, err := conn.db.Query(`SELECT class, profile, maxenroll, enrollments, expiry, revoked
+		FROM bootstrap ORDER BY class`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*BootstrapClass
+	for rows.Next() {
+		class, err := scanBootstrapClass(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, class)
+	}
+
+	return result, rows.Err()
+}
+
+func scanBootstrapClass(row interface{ Scan(...interface{}) error }) (*BootstrapClass, error) {
+	var class BootstrapClass
+	var profile sql.NullString
+	var maxEnroll sql.NullInt64
+	err := row.Scan(&class.Name, &profile, &maxEnroll, &class.Enrollments,
+		&class.Expiry, &class.Revoked)
+	if err != nil {
+		return nil, err
+	}
+	class.Profile = profile.String
+	class.MaxEnroll = int(maxEnroll.Int64)
+	return &class, nil
+}
+
+// ConsumeEnrollment counts an enrollment against the bootstrap class
+// with the given name.  Returns EnrollmentLimit if the class has
+// already made all of the enrollments it is permitted.
+func (conn *Conn) ConsumeEnrollment(name string) error {
+	res, err := conn.db.Exec(`UPDATE bootstrap
+		SET enrollments = enrollments + 1
+		WHERE class = ? AND (maxenroll IS NULL OR enrollments < maxenroll)`, name)
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return EnrollmentLimit
+	}
+	return nil
+}
+
+// ReleaseEnrollment returns an enrollment counted by
+// ConsumeEnrollment, when the enrollment failed.
+func (conn *Conn) ReleaseEnrollment(name string) error {
+	_, err := conn.db.Exec(`UPDATE bootstrap
+		SET enrollments = enrollments - 1
+		WHERE class = ? AND enrollments > 0`, name)
+	return err
+}
+
+// RevokeBootstrapClass marks the bootstrap class with the given name
+// as revoked, and revokes each of its certificates with the RFC 5280
+// reason code, so that they also appear in the CRL.
+func (conn *Conn) RevokeBootstrapClass(name string, reason int) error {
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`UPDATE bootstrap SET revoked = 1 WHERE class = ?`, name)
+	if err == nil {
+		var count int64
+		count, err = res.RowsAffected()
+		if err == nil && count == 0 {
+			err = UnknownClass
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE certs
+			SET valid = 0, revoked = ?, reason = ?
+			WHERE id = ? AND name = ? AND revoked IS NULL`,
+			time.Now().UTC(), reason, BootstrapId, name)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	return err
+}
+
+// CertRevoked returns true if the certificate with the given serial
+// has been revoked.  Certificates unknown to the database are not.
+func (conn *Conn) CertRevoked(serial *big.Int) (bool, error) {
+	rev, err := conn.RevocationStatus(serial)
+	if err == UnknownSerial {
+		return false, nil
+	}
+	return rev != nil, err
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullLimit(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n > 0}
+}
@@ -6,22 +6,41 @@ package cadb // import "github.com/Linaro/lite_bootstrap_server/cadb"
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/viper"
 )
 
 type Conn struct {
-	db *sql.DB
+	db *database
 }
 
+// Open connects to the CA database named by the `database.dsn`
+// setting, creating or upgrading its schema as needed.  Several
+// servers may share a PostgreSQL database.
 func Open() (*Conn, error) {
-	db, err := sql.Open("sqlite3", "CADB.db")
+	return openDSN(viper.GetString("database.dsn"))
+}
+
+// openDSN connects to the CA database with the given data source name.
+func openDSN(name string) (*Conn, error) {
+	driver, dsn, dialect := dataSource(name)
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
 		return nil, err
 	}
+	if dialect == sqliteDialect {
+		// SQLite only allows one writer at a time, and lets
+		// waiting writers retry in any order, so under load
+		// some can time out.  Queue them here instead.  No
+		// query is made while another is open.
+		db.SetMaxOpenConns(1)
+	}
 
 	conn := &Conn{
-		db: db,
+		db: &database{DB: db, dialect: dialect},
 	}
 
 	err = conn.checkSchema()
@@ -32,3 +51,16 @@ func Open() (*Conn, error) {
 
 	return conn, nil
 }
+
+// LocalFile returns the name of the SQLite database file named by the
+// `database.dsn` setting, or "" if the database is not a local file.
+func LocalFile() string {
+	driver, dsn, _ := dataSource(viper.GetString("database.dsn"))
+	if driver != "sqlite3" {
+		return ""
+	}
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		dsn = dsn[:i]
+	}
+	return strings.TrimPrefix(dsn, "file:")
+}
@@ -0,0 +1,496 @@
+package cadb
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postgresEnv names the environment variable holding the DSN of a
+// PostgreSQL server to run the tests against as well, such as
+// "postgres://liteboot@localhost/liteboot_test?sslmode=disable".  The
+// tests use a schema of their own, which is dropped afterwards.
+// Otherwise, a server is started for the tests; see postgres_test.go.
+const postgresEnv = "LITEBOOT_TEST_POSTGRES"
+
+// forEachBackend runs a test against a new SQLite database, and
+// against PostgreSQL, unless no server is available.
+func forEachBackend(t *testing.T, test func(t *testing.T, conn *Conn)) {
+	t.Run("sqlite", func(t *testing.T) {
+		conn, err := openDSN(filepath.Join(t.TempDir(), "CADB.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.db.Close()
+		test(t, conn)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		conn := openPostgres(t, postgresDSN(t))
+		defer conn.db.Close()
+		test(t, conn)
+	})
+}
+
+// openPostgres opens the CA database in a new schema on the given
+// server, which is dropped when the test finishes.
+func openPostgres(t *testing.T, dsn string) *Conn {
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("liteboot_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec(`CREATE SCHEMA ` + schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		if err != nil {
+			t.Errorf("drop schema: %v", err)
+		}
+	})
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	conn, err := openDSN(dsn + sep + "search_path=" + schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// addTestCert adds a certificate for the device with a new serial,
+// and returns the serial.  The certificate itself is never parsed, so
+// random bytes will do.
+func addTestCert(t *testing.T, conn *Conn, id string) *big.Int {
+	ser, err := conn.GetSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := make([]byte, 32)
+	rand.Read(der)
+	err = conn.AddCert(id, "test", "default", ser, der[:20], time.Now().Add(time.Hour), der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ser
+}
+
+func TestCerts(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, conn *Conn) {
+		ser := addTestCert(t, conn, "device-1")
+
+		id, _, valid, err := conn.CertOwner(ser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "device-1" || !valid {
+			t.Errorf("CertOwner = %q, %v; want \"device-1\", true", id, valid)
+		}
+
+		_, _, _, err = conn.CertOwner(big.NewInt(1))
+		if err != UnknownSerial {
+			t.Errorf("CertOwner of unknown serial: %v; want %v", err, UnknownSerial)
+		}
+
+		// A serial already used for a certificate can't be
+		// reserved again.
+		err = conn.reserveSerial(ser)
+		if err != NonUnique {
+			t.Errorf("reserveSerial of used serial: %v; want %v", err, NonUnique)
+		}
+	})
+}
+
+func TestUnregisteredDevices(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, conn *Conn) {
+		const device = "0b9d6c1e-2f3a-4b5c-8d7e-9f0a1b2c3d4e"
+		for _, id := range []string{BootstrapId, ServerId, OCSPSignerId, device} {
+			addTestCert(t, conn, id)
+		}
+
+		// Only the device is left to register, not the
+		// certificates the server records for itself.
+		devs, err := conn.UnregisteredDevices()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devs) != 1 || devs[0] != device {
+			t.Errorf("UnregisteredDevices = %v; want [%s]", devs, device)
+		}
+
+		err = conn.MarkRegistered(device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		devs, err = conn.UnregisteredDevices()
+		if err != nil || len(devs) != 0 {
+			t.Errorf("UnregisteredDevices after registration = %v, %v; want none", devs, err)
+		}
+	})
+}
+
+func TestRevokeCert(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, conn *Conn) {
+		err := conn.RevokeCert(big.NewInt(1), 1)
+		if err != UnknownSerial {
+			t.Errorf("RevokeCert of unknown serial: %v; want %v", err, UnknownSerial)
+		}
+
+		ser := addTestCert(t, conn, "device-1")
+
+		// Of several concurrent revocations, only one
+		// succeeds.
+		const workers = 8
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(reason int) {
+				defer wg.Done()
+				errs <- conn.RevokeCert(ser, reason)
+			}(i + 1)
+		}
+		wg.Wait()
+		close(errs)
+
+		revoked := 0
+		for err := range errs {
+			switch err {
+			case nil:
+				revoked++
+			case AlreadyRevoked:
+			default:
+				t.Errorf("RevokeCert: %v", err)
+			}
+		}
+		if revoked != 1 {
+			t.Errorf("%d revocations succeeded; want 1", revoked)
+		}
+
+		rev, err := conn.RevocationStatus(ser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev == nil {
+			t.Fatal("certificate is not revoked")
+		}
+		valid, err := conn.SerialValid(ser)
+		if err != nil || valid {
+			t.Errorf("SerialValid = %v, %v; want false", valid, err)
+		}
+	})
+}
+
+func TestNextCRLNumber(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, conn *Conn) {
+		const workers = 8
+		const each = 10
+
+		var mu sync.Mutex
+		seen := make(map[int64]bool)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < each; j++ {
+					number, err := conn.NextCRLNumber()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					if seen[number.Int64()] {
+						t.Errorf("CRL number %v returned twice", number)
+					}
+					seen[number.Int64()] = true
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		// The numbers handed out run from 1, without gaps.
+		for n := int64(1); n <= workers*each; n++ {
+			if !seen[n] {
+				t.Errorf("CRL number %d was not returned", n)
+			}
+		}
+	})
+}
+
+func TestChallenge(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, conn *Conn) {
+		nonce := []byte("0123456789abcdef")
+		err := conn.AddPendingDevice("device-1", "hw-1", nil, nonce, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = conn.CheckChallenge("device-1", []byte("wrong"))
+		if err != BadChallenge {
+			t.Errorf("CheckChallenge with wrong nonce: %v; want %v", err, BadChallenge)
+		}
+		err = conn.CheckChallenge("device-2", nonce)
+		if err != BadChallenge {
+			t.Errorf("CheckChallenge of unknown device: %v; want %v", err, BadChallenge)
+		}
+
+		// Checking the nonce doesn't use it up.
+		for i := 0; i < 2; i++ {
+			err = conn.CheckChallenge("device-1", nonce)
+			if err != nil {
+				t.Fatalf("CheckChallenge: %v", err)
+			}
+		}
+
+		// Of several concurrent certificates with the same
+		// nonce, only one is recorded.
+		const workers = 8
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ser, err := conn.GetSerial()
+				if err == nil {
+					err = conn.AddEnrolledCert("device-1", "test", "default", ser,
+						[]byte("keyid"), time.Now().Add(time.Hour), []byte("cert"), nonce)
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		enrolled := 0
+		for err := range errs {
+			switch err {
+			case nil:
+				enrolled++
+			case BadChallenge:
+			default:
+				t.Errorf("AddEnrolledCert: %v", err)
+			}
+		}
+		if enrolled != 1 {
+			t.Errorf("%d enrollments succeeded; want 1", enrolled)
+		}
+
+		state, err := conn.DeviceState("device-1")
+		if err != nil || state != DeviceEnrolled {
+			t.Errorf("DeviceState = %q, %v; want %q", state, err, DeviceEnrolled)
+		}
+		err = conn.CheckChallenge("device-1", nonce)
+		if err != BadChallenge {
+			t.Errorf("CheckChallenge after enrollment: %v; want %v", err, BadChallenge)
+		}
+	})
+}
+
+func TestAddDeviceCert(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, conn *Conn) {
+		// Of several concurrent first certificates for a device,
+		// only one is recorded.
+		const workers = 8
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ser, err := conn.GetSerial()
+				if err == nil {
+					err = conn.AddDeviceCert("device-1", "test", "default", ser,
+						[]byte("keyid"), time.Now().Add(time.Hour), []byte("cert"))
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		added := 0
+		for err := range errs {
+			switch err {
+			case nil:
+				added++
+			case DeviceExists:
+			default:
+				t.Errorf("AddDeviceCert: %v", err)
+			}
+		}
+		if added != 1 {
+			t.Errorf("%d certificates added; want 1", added)
+		}
+
+		// A pending device has to use its nonce.
+		err := conn.AddPendingDevice("device-2", "hw-2", nil, []byte("nonce"), time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = conn.AddDeviceCert("device-2", "test", "default", big.NewInt(2),
+			[]byte("keyid"), time.Now().Add(time.Hour), []byte("cert"))
+		if err != DeviceExists {
+			t.Errorf("AddDeviceCert of pending device: %v; want %v", err, DeviceExists)
+		}
+	})
+}
+
+func TestAddPendingDevice(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, conn *Conn) {
+		// Of several concurrent requests for a device with
+		// different hardware serial numbers, only one is
+		// recorded.
+		const workers = 8
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- conn.AddPendingDevice("device-1", fmt.Sprintf("hw-%d", i), nil,
+					[]byte("nonce"), time.Now().Add(time.Minute))
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		added := 0
+		for err := range errs {
+			switch err {
+			case nil:
+				added++
+			case DeviceExists:
+			default:
+				t.Errorf("AddPendingDevice: %v", err)
+			}
+		}
+		if added != 1 {
+			t.Errorf("%d devices added; want 1", added)
+		}
+
+		// A pending device may repeat its request, which replaces
+		// the nonce.
+		err := conn.AddPendingDevice("device-2", "hw-2", nil, []byte("nonce-1"), time.Now().Add(time.Minute))
+		if err == nil {
+			err = conn.AddPendingDevice("device-2", "hw-2", nil, []byte("nonce-2"), time.Now().Add(time.Minute))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = conn.CheckChallenge("device-2", []byte("nonce-1")); err != BadChallenge {
+			t.Errorf("CheckChallenge of replaced nonce: %v; want %v", err, BadChallenge)
+		}
+		if err = conn.CheckChallenge("device-2", []byte("nonce-2")); err != nil {
+			t.Errorf("CheckChallenge of new nonce: %v", err)
+		}
+
+		// But not once it has enrolled.
+		addTestCert(t, conn, "device-3")
+		err = conn.AddPendingDevice("device-3", "", nil, []byte("nonce"), time.Now().Add(time.Minute))
+		if err != DeviceExists {
+			t.Errorf("AddPendingDevice of enrolled device: %v; want %v", err, DeviceExists)
+		}
+	})
+}
+
+func TestExpiredChallenge(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, conn *Conn) {
+		nonce := []byte("0123456789abcdef")
+		err := conn.AddPendingDevice("device-1", "hw-1", nil, nonce, time.Now().Add(-time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = conn.AddEnrolledCert("device-1", "test", "default", big.NewInt(2),
+			[]byte("keyid"), time.Now().Add(time.Hour), []byte("cert"), nonce)
+		if err != BadChallenge {
+			t.Errorf("AddEnrolledCert with expired nonce: %v; want %v", err, BadChallenge)
+		}
+
+		// The device is left pending, and has no certificate.
+		state, err := conn.DeviceState("device-1")
+		if err != nil || state != DevicePending {
+			t.Errorf("DeviceState = %q, %v; want %q", state, err, DevicePending)
+		}
+		_, _, _, err = conn.CertOwner(big.NewInt(2))
+		if err != UnknownSerial {
+			t.Errorf("CertOwner: %v; want %v", err, UnknownSerial)
+		}
+	})
+}
+
+func TestConcurrentSerials(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, conn *Conn) {
+		const workers = 16
+		const each = 250
+
+		serials := make(chan *big.Int, workers*each)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				id := fmt.Sprintf("device-%d", worker)
+				for j := 0; j < each; j++ {
+					ser, err := conn.GetSerial()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					err = conn.AddCert(id, "test", "default", ser, []byte("keyid"),
+						time.Now().Add(time.Hour), ser.Bytes())
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					serials <- ser
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(serials)
+
+		seen := make(map[string]bool)
+		for ser := range serials {
+			if ser.Sign() <= 0 || ser.BitLen() > serialBits {
+				t.Errorf("serial %x out of range", ser)
+			}
+			key := serialKey(ser)
+			if seen[key] {
+				t.Errorf("serial %s issued twice", key)
+			}
+			seen[key] = true
+		}
+		if len(seen) != workers*each {
+			t.Fatalf("%d certificates issued; want %d", len(seen), workers*each)
+		}
+
+		// Every serial is recorded, once, in both tables.
+		for _, table := range []string{"certs", "serials"} {
+			var count, distinct int
+			err := conn.db.QueryRow(`SELECT COUNT(*), COUNT(DISTINCT serial) FROM `+table).
+				Scan(&count, &distinct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != workers*each || distinct != count {
+				t.Errorf("%s holds %d serials, %d distinct; want %d", table, count, distinct, workers*each)
+			}
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package cadb
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Enrollment states of a device.
+const (
+	DevicePending  = "pending"
+	DeviceEnrolled = "enrolled"
+)
+
+// UnknownDevice is an error that indicates the device is not in the
+// database.
+var UnknownDevice = errors.New("Unknown Device")
+
+// DeviceExists is an error that indicates an initialisation request
+// was made for a device that has already been enrolled, or is pending
+// with a different hardware serial number.
+var DeviceExists = errors.New("Device Already Exists")
+
+// BadChallenge is an error that indicates the nonce given for a
+// pending device did not match, or has expired.
+var BadChallenge = errors.New("Invalid Enrollment Challenge")
+
+// AddPendingDevice records a device that has made an initialisation
+// request, along with the nonce it must echo to complete enrollment.
+// A device that is still pending may repeat the request, which will
+// replace the nonce.
+func (conn *Conn) AddPendingDevice(id string, hwserial string, attestation []byte, nonce []byte, expiry time.Time) error {
+	// A device that is already known is only updated if it is still
+	// pending with the same hardware serial number.  Otherwise,
+	// nothing is changed, and no row is affected.
+	res, err := conn.db.Exec(`INSERT INTO devices
+		(id, registered, state, hwserial, attestation, nonce, nonceexpiry)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE
+		SET attestation = excluded.attestation, nonce = excluded.nonce,
+			nonceexpiry = excluded.nonceexpiry
+		WHERE devices.state = excluded.state
+			AND COALESCE(devices.hwserial, '') = excluded.hwserial`,
+		id, 0, DevicePending, hwserial, attestation, nonce, expiry)
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return DeviceExists
+	}
+	return nil
+}
+
+// DeviceState returns the enrollment state of the given device, or
+// UnknownDevice if it isn't in the database.
+func (conn *Conn) DeviceState(id string) (string, error) {
+	var state string
+	err := conn.db.QueryRow(`SELECT state FROM devices WHERE id = ?`, id).
+		Scan(&state)
+	if err == sql.ErrNoRows {
+		return "", UnknownDevice
+	}
+	return state, err
+}
+
+// CheckChallenge checks the nonce given by a pending device, without
+// using it up.  This lets a request be checked in full before the
+// certificate is issued with AddEnrolledCert, which consumes the
+// nonce.
+func (conn *Conn) CheckChallenge(id string, nonce []byte) error {
+	return checkChallenge(conn.db.QueryRow, id, nonce)
+}
+
+// checkChallenge checks that the device is pending, and that its nonce
+// matches and has not expired.
+func checkChallenge(queryRow func(string, ...interface{}) *sql.Row, id string, nonce []byte) error {
+	var state string
+	var expected []byte
+	var expiry sql.NullTime
+	err := queryRow(`SELECT state, nonce, nonceexpiry FROM devices WHERE id = ?`, id).
+		Scan(&state, &expected, &expiry)
+	if err == sql.ErrNoRows {
+		return BadChallenge
+	}
+	if err != nil {
+		return err
+	}
+
+	if state != DevicePending || !expiry.Valid || time.Now().After(expiry.Time) ||
+		subtle.ConstantTimeCompare(expected, nonce) != 1 {
+		return BadChallenge
+	}
+	return nil
+}
+
+// consumeChallenge checks the nonce given by a pending device, and if
+// it matches and has not expired, marks the device as enrolled, as
+// part of the transaction.  Each nonce can only be used once: the
+// update only applies while the device is still pending with the same
+// nonce, so of two concurrent requests only one succeeds.
+func consumeChallenge(tx *transaction, id string, nonce []byte) error {
+	err := checkChallenge(tx.QueryRow, id, nonce)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`UPDATE devices
+		SET state = ?, nonce = NULL, nonceexpiry = NULL
+		WHERE id = ? AND state = ? AND nonce = ?`,
+		DeviceEnrolled, id, DevicePending, nonce)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return BadChallenge
+	}
+	return nil
+}
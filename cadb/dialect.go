@@ -0,0 +1,129 @@
+package cadb
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Linaro/lite_bootstrap_server/datadir"
+)
+
+// A dialect is one of the SQL databases that the CA database can be
+// kept in.  Queries are written for SQLite, and rewritten as needed
+// for the others.
+type dialect int
+
+const (
+	sqliteDialect dialect = iota
+	postgresDialect
+)
+
+// dataSource returns the driver and dialect to use for a data source
+// name.  A `postgres://` or `postgresql://` URL selects PostgreSQL,
+// anything else is the name of an SQLite database file, by default
+// "CADB.db" in the data directory.
+func dataSource(dsn string) (string, string, dialect) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return "postgres", dsn, postgresDialect
+	}
+
+	if dsn == "" {
+		dsn = datadir.Path("CADB.db")
+	}
+	if !strings.Contains(dsn, "?") {
+		// Requests are handled concurrently, so wait for other
+		// writers, rather than failing, and take the write lock
+		// at the start of each transaction, as most of them
+		// write.
+		dsn += "?_busy_timeout=5000&_txlock=immediate"
+	}
+	return "sqlite3", dsn, sqliteDialect
+}
+
+// rebind rewrites the `?` placeholders in a query into the numbered
+// form PostgreSQL expects.
+func (d dialect) rebind(query string) string {
+	if d != postgresDialect || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+var ddlTypes = regexp.MustCompile(`\b(STRING|BLOB|DATE)\b`)
+
+// ddl rewrites the column types in a statement from the schema.  The
+// schema uses SQLite's names, and DATE columns hold a time as well.
+func (d dialect) ddl(stmt string) string {
+	if d != postgresDialect {
+		return stmt
+	}
+
+	return ddlTypes.ReplaceAllStringFunc(stmt, func(name string) string {
+		switch name {
+		case "STRING":
+			return "TEXT"
+		case "BLOB":
+			return "BYTEA"
+		default:
+			return "TIMESTAMP WITH TIME ZONE"
+		}
+	})
+}
+
+// A database is a connection to the CA database, that rewrites
+// queries for its dialect.
+type database struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (db *database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db *database) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rebind(query), args...)
+}
+
+func (db *database) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rebind(query), args...)
+}
+
+func (db *database) Begin() (*transaction, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{Tx: tx, dialect: db.dialect}, nil
+}
+
+// A transaction is a transaction on the CA database, that rewrites
+// queries for its dialect.
+type transaction struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (tx *transaction) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *transaction) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx *transaction) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
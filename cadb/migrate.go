@@ -0,0 +1,273 @@
+package cadb
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"time"
+)
+
+// A migration upgrades the database from one schema version to the
+// next.  It is applied within a single transaction.
+type migration struct {
+	from, to string
+	apply    func(tx *transaction) error
+}
+
+// execAll returns a migration that runs the given statements in order.
+// Column types are rewritten for the dialect, as in the schema.
+func execAll(stmts ...string) func(tx *transaction) error {
+	return func(tx *transaction) error {
+		for _, item := range stmts {
+			_, err := tx.Exec(tx.dialect.ddl(item))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrations upgrades databases created by earlier versions.  They
+// are listed in order, starting from the original schema, and the
+// last must leave the database at schemaVersion.  Databases created
+// fresh get the full schema directly, so a change to the schema needs
+// both an update there and a migration here.
+var migrations = []migration{
+	{"20220215a", "20261017a", execAll(
+		`ALTER TABLE certs ADD COLUMN replaces STRING`,
+	)},
+	{"20261017a", "20261017b", execAll(
+		`ALTER TABLE certs ADD COLUMN revoked DATE`,
+		`ALTER TABLE certs ADD COLUMN reason INTEGER`,
+	)},
+	{"20261017b", "20261017c", execAll(
+		// Devices that exist already were registered through
+		// an enrollment, and have no attestation.
+		`ALTER TABLE devices ADD COLUMN state STRING NOT NULL DEFAULT 'enrolled'`,
+		`ALTER TABLE devices ADD COLUMN hwserial STRING`,
+		`ALTER TABLE devices ADD COLUMN attestation BLOB`,
+		`ALTER TABLE devices ADD COLUMN nonce BLOB`,
+		`ALTER TABLE devices ADD COLUMN nonceexpiry DATE`,
+	)},
+	{"20261017c", "20261017d", execAll(
+		`ALTER TABLE certs ADD COLUMN profile STRING`,
+	)},
+	{"20261017d", "20261017e", execAll(
+		`CREATE TABLE bootstrap (class STRING PRIMARY KEY,
+			profile STRING,
+			maxenroll INTEGER,
+			enrollments INTEGER NOT NULL,
+			expiry DATE NOT NULL,
+			revoked INTEGER NOT NULL)`,
+	)},
+	{"20261017e", "20261017f", migrateSerials},
+	{"20261017f", "20261017g", execAll(
+		`CREATE TABLE serials (serial TEXT PRIMARY KEY)`,
+		`INSERT INTO serials (serial) SELECT serial FROM certs`,
+	)},
+}
+
+// migrate upgrades the database from the schema `version` to
+// schemaVersion.  Each migration is applied in its own transaction,
+// which also records it in the settings, so an upgrade that fails
+// part way leaves the database at the last version that succeeded.
+func (conn *Conn) migrate(version string) error {
+	start := -1
+	for i := range migrations {
+		if migrations[i].from == version {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		// Versions are dates, so sort in order.
+		if version > schemaVersion {
+			return fmt.Errorf("database schema %q is newer than %q, upgrade liteboot to use it",
+				version, schemaVersion)
+		}
+		return fmt.Errorf("database schema %q is not known", version)
+	}
+
+	for _, m := range migrations[start:] {
+		log.Printf("Upgrading database schema from %q to %q\n", m.from, m.to)
+		err := conn.applyMigration(&m)
+		if err != nil {
+			return fmt.Errorf("upgrading database schema to %q: %v", m.to, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration runs a single migration, and records the new version.
+func (conn *Conn) applyMigration(m *migration) error {
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = m.apply(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Check the version again inside of the transaction, in case
+	// another process has upgraded the database in the meantime.
+	res, err := tx.Exec(`UPDATE settings SET value = ? WHERE key = 'schemaVersion' AND value = ?`,
+		m.to, m.from)
+	if err == nil {
+		var count int64
+		count, err = res.RowsAffected()
+		if err == nil && count == 0 {
+			err = fmt.Errorf("database schema is no longer %q", m.from)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO settings VALUES (?, ?)`,
+			"migration:"+m.to, time.Now().UTC().Format(time.RFC3339))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	return err
+}
+
+// migrateSerials rewrites the serials in certs from the decimal
+// integers that earlier versions stored, which were truncated to 64
+// bits, as hex text.  The serial is taken from the certificate itself
+// where possible.  Only SQLite databases are old enough to need this.
+func migrateSerials(tx *transaction) error {
+	err := execAll(
+		`CREATE TABLE certs_new (id STRING NOT NULL REFERENCES devices(id),
+			name STRING NOT NULL,
+			profile STRING,
+			serial TEXT NOT NULL,
+			keyid BLOB NOT NULL,
+			cert BLOB NOT NULL,
+			expiry DATE NOT NULL,
+			valid INTEGER NOT NULL,
+			replaces TEXT,
+			revoked DATE,
+			reason INTEGER,
+			PRIMARY KEY (id, serial))`,
+	)(tx)
+	if err != nil {
+		return err
+	}
+
+	type row struct {
+		rowid    int64
+		id       string
+		serial   string
+		replaces sql.NullString
+		cert     []byte
+	}
+	var certs []row
+
+	rows, err := tx.Query(`SELECT rowid, id, CAST(serial AS TEXT), CAST(replaces AS TEXT), cert
+		FROM certs`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var r row
+		err = rows.Scan(&r.rowid, &r.id, &r.serial, &r.replaces, &r.cert)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		certs = append(certs, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// Map each old serial to the new one, so that `replaces` can
+	// be rewritten to match.
+	keys := make(map[string]string)
+	devices := make(map[string][]*big.Int)
+	for _, r := range certs {
+		serial, ok := new(big.Int).SetString(r.serial, 10)
+		if crt, err := x509.ParseCertificate(r.cert); err == nil {
+			serial, ok = crt.SerialNumber, true
+		}
+		if !ok {
+			return fmt.Errorf("invalid serial in db: %q", r.serial)
+		}
+		keys[r.serial] = serialKey(serial)
+		devices[r.id] = append(devices[r.id], serial)
+	}
+
+	for _, r := range certs {
+		var replaces sql.NullString
+		if r.replaces.Valid {
+			key, ok := keys[r.replaces.String]
+			if !ok {
+				var serial *big.Int
+				serial, ok = new(big.Int).SetString(r.replaces.String, 10)
+				if !ok {
+					// Serials too large for an integer were
+					// stored as floating point, so look for
+					// the device's certificate that is
+					// closest.
+					serial, ok = nearestSerial(r.replaces.String, devices[r.id])
+				}
+				if ok {
+					key = serialKey(serial)
+				}
+			}
+			if ok {
+				replaces = sql.NullString{String: key, Valid: true}
+			} else {
+				log.Printf("Dropping unknown replaced serial %q of %q\n", r.replaces.String, r.id)
+			}
+		}
+
+		_, err = tx.Exec(`INSERT INTO certs_new (id, name, profile, serial, keyid, cert, expiry, valid, replaces, revoked, reason)
+			SELECT id, name, profile, ?, keyid, cert, expiry, valid, ?, revoked, reason
+			FROM certs WHERE rowid = ?`,
+			keys[r.serial], replaces, r.rowid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return execAll(
+		`DROP TABLE certs`,
+		`ALTER TABLE certs_new RENAME TO certs`,
+		`CREATE UNIQUE INDEX certs_serial ON certs (serial)`,
+	)(tx)
+}
+
+// nearestSerial finds the serial, among those of a device's
+// certificates, that was rounded to the floating point `value`.
+func nearestSerial(value string, serials []*big.Int) (*big.Int, bool) {
+	f, _, err := big.ParseFloat(value, 10, 53, big.ToNearestEven)
+	if err != nil || f.Sign() <= 0 {
+		return nil, false
+	}
+
+	// Rounding to the precision of a float64 is only approximate,
+	// so take the closest, allowing for an error in the last digit
+	// printed.
+	var nearest *big.Int
+	best := 1e-11
+	for _, serial := range serials {
+		diff := new(big.Float).SetInt(serial)
+		diff.Sub(diff, f)
+		diff.Quo(diff, f)
+		if d, _ := diff.Float64(); math.Abs(d) < best {
+			nearest, best = serial, math.Abs(d)
+		}
+	}
+	return nearest, nearest != nil
+}
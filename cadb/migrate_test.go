@@ -0,0 +1,239 @@
+package cadb
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The fixtures in testdata were written by earlier versions of
+// liteboot:
+//
+//   - 20220215a.db, the original schema, has a registered device with
+//     a clock based serial, a device whose certificate has a 20 octet
+//     serial, truncated to 64 bits in certs, and a record whose
+//     certificate can't be parsed.
+//
+//   - 20261017e.db, the last schema with integer serials, has a device
+//     with a 20 octet serial that was renewed, so that `replaces` holds
+//     the full serial, which SQLite stored as floating point, a revoked
+//     certificate, a pending device and a bootstrap class.
+
+// Devices in the fixtures.
+const (
+	fixtureDeviceA = "3b0f8a4c-7f0e-4c4e-9a53-6f8f1a1b2c3d"
+	fixtureDeviceB = "9e1c2d3f-5a6b-4c7d-8e9f-0a1b2c3d4e5f"
+	fixtureDeviceC = "c0ffee00-1111-4222-8333-444455556666"
+)
+
+// openFixture opens a copy of a database from testdata, upgrading it.
+func openFixture(t *testing.T, name string) (*Conn, error) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "CADB.db")
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openDSN(path)
+}
+
+// fixtureCert is a row of certs after an upgrade.
+type fixtureCert struct {
+	id       string
+	serial   string
+	replaces sql.NullString
+	cert     []byte
+}
+
+func fixtureCerts(t *testing.T, conn *Conn) []fixtureCert {
+	rows, err := conn.db.Query(`SELECT id, serial, replaces, cert FROM certs ORDER BY rowid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var certs []fixtureCert
+	for rows.Next() {
+		var c fixtureCert
+		err = rows.Scan(&c.id, &c.serial, &c.replaces, &c.cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, c)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+// checkUpgraded checks the parts of an upgraded database common to
+// every fixture: the version, the record of each migration, and that
+// each serial is the one from the certificate, and reserved.
+func checkUpgraded(t *testing.T, conn *Conn, from string) []fixtureCert {
+	var version string
+	err := conn.db.QueryRow(`SELECT value FROM settings WHERE key = 'schemaVersion'`).
+		Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != schemaVersion {
+		t.Errorf("schemaVersion = %q; want %q", version, schemaVersion)
+	}
+
+	applied := false
+	for _, m := range migrations {
+		applied = applied || m.from == from
+		var when string
+		err = conn.db.QueryRow(`SELECT value FROM settings WHERE key = ?`, "migration:"+m.to).
+			Scan(&when)
+		switch {
+		case applied && err != nil:
+			t.Errorf("migration to %q not recorded: %v", m.to, err)
+		case !applied && err == nil:
+			t.Errorf("migration to %q recorded, but not needed", m.to)
+		}
+	}
+
+	certs := fixtureCerts(t, conn)
+	for _, c := range certs {
+		crt, err := x509.ParseCertificate(c.cert)
+		if err != nil {
+			continue
+		}
+		if want := serialKey(crt.SerialNumber); c.serial != want {
+			t.Errorf("%s: serial %q; want %q from the certificate", c.id, c.serial, want)
+		}
+
+		id, _, _, err := conn.CertOwner(crt.SerialNumber)
+		if err != nil || id != c.id {
+			t.Errorf("CertOwner(%x) = %q, %v; want %q", crt.SerialNumber, id, err, c.id)
+		}
+		err = conn.reserveSerial(crt.SerialNumber)
+		if err != NonUnique {
+			t.Errorf("reserveSerial(%x) of upgraded certificate: %v; want %v",
+				crt.SerialNumber, err, NonUnique)
+		}
+	}
+	return certs
+}
+
+func TestUpgradeOriginal(t *testing.T) {
+	conn, err := openFixture(t, "20220215a.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.db.Close()
+
+	certs := checkUpgraded(t, conn, "20220215a")
+	if len(certs) != 3 {
+		t.Fatalf("%d certificates after upgrade; want 3", len(certs))
+	}
+
+	// The 20 octet serial is recovered from the certificate,
+	// rather than the truncated one.
+	if len(certs[1].serial) != 40 {
+		t.Errorf("serial %q; want the full 20 octets", certs[1].serial)
+	}
+
+	// Without a certificate, the stored serial is kept.
+	if certs[2].id != fixtureDeviceC || certs[2].serial != serialKey(big.NewInt(12345)) {
+		t.Errorf("unparsable certificate: %s serial %q; want %s serial %q",
+			certs[2].id, certs[2].serial, fixtureDeviceC, serialKey(big.NewInt(12345)))
+	}
+
+	// Existing devices count as enrolled, and keep their
+	// registration.
+	for _, id := range []string{fixtureDeviceA, fixtureDeviceB, fixtureDeviceC} {
+		state, err := conn.DeviceState(id)
+		if err != nil || state != DeviceEnrolled {
+			t.Errorf("DeviceState(%s) = %q, %v; want %q", id, state, err, DeviceEnrolled)
+		}
+	}
+	unregistered, err := conn.UnregisteredDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(unregistered, ",") != fixtureDeviceB+","+fixtureDeviceC {
+		t.Errorf("UnregisteredDevices = %v; want [%s %s]", unregistered, fixtureDeviceB, fixtureDeviceC)
+	}
+
+	// New certificates can be added after the upgrade.
+	addTestCert(t, conn, fixtureDeviceA)
+}
+
+func TestUpgradeIntegerSerials(t *testing.T) {
+	conn, err := openFixture(t, "20261017e.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.db.Close()
+
+	certs := checkUpgraded(t, conn, "20261017e")
+	if len(certs) != 3 {
+		t.Fatalf("%d certificates after upgrade; want 3", len(certs))
+	}
+
+	// The renewal refers to the certificate it replaced, by its
+	// full serial.
+	if !certs[1].replaces.Valid || certs[1].replaces.String != certs[0].serial {
+		t.Errorf("replaces = %v; want %q", certs[1].replaces, certs[0].serial)
+	}
+
+	// Revocations, profiles, pending devices and bootstrap
+	// classes are kept.
+	ser, _ := parseSerial(certs[2].serial)
+	rev, err := conn.RevocationStatus(ser)
+	if err != nil || rev == nil || rev.Reason != 1 {
+		t.Errorf("RevocationStatus = %v, %v; want revoked with reason 1", rev, err)
+	}
+	ser, _ = parseSerial(certs[1].serial)
+	profile, err := conn.CertProfile(ser)
+	if err != nil || profile != "default" {
+		t.Errorf("CertProfile = %q, %v; want \"default\"", profile, err)
+	}
+	err = conn.CheckChallenge(fixtureDeviceC, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Errorf("CheckChallenge of pending device: %v", err)
+	}
+	class, err := conn.GetBootstrapClass("LinaroCA Bootstrap Cert")
+	if err != nil || class.MaxEnroll != 10 {
+		t.Errorf("GetBootstrapClass = %+v, %v; want MaxEnroll 10", class, err)
+	}
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	for _, test := range []struct {
+		version string
+		want    string
+	}{
+		{"29991231a", "is newer than"},
+		{"20211231a", "is not known"},
+	} {
+		t.Run(test.version, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "CADB.db")
+			conn, err := openDSN(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = conn.db.Exec(`UPDATE settings SET value = ? WHERE key = 'schemaVersion'`,
+				test.version)
+			conn.db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = openDSN(path)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("open of schema %q: %v; want %q", test.version, err, test.want)
+			}
+		})
+	}
+}
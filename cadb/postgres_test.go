@@ -0,0 +1,133 @@
+package cadb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// postgresBinEnv names the environment variable holding the directory
+// of the PostgreSQL server programs, such as
+// "/usr/lib/postgresql/16/bin", if they aren't on the PATH.  When
+// `postgresEnv` isn't set, the tests start a server of their own from
+// these, in a temporary directory, and stop it afterwards.
+const postgresBinEnv = "LITEBOOT_TEST_PG_BIN"
+
+// postgresRequireEnv names the environment variable which, when set,
+// makes the tests fail rather than skip if PostgreSQL can't be found,
+// so that CI doesn't pass without having run them.
+const postgresRequireEnv = "LITEBOOT_TEST_REQUIRE_POSTGRES"
+
+// The ephemeral server, started by the first test that needs it.
+var ephemeral struct {
+	once sync.Once
+	dir  string
+	ctl  string
+	dsn  string
+	err  error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	stopPostgres()
+	os.Exit(code)
+}
+
+// postgresDSN returns the DSN of the server to test against, either
+// given in the environment or started for the tests.  Skips the test
+// if there is neither.
+func postgresDSN(t *testing.T) string {
+	if dsn := os.Getenv(postgresEnv); dsn != "" {
+		return dsn
+	}
+
+	ephemeral.once.Do(startPostgres)
+	if ephemeral.err != nil {
+		if os.Getenv(postgresRequireEnv) != "" {
+			t.Fatalf("PostgreSQL: %v", ephemeral.err)
+		}
+		t.Skipf("PostgreSQL: %v; set %s or %s", ephemeral.err, postgresEnv, postgresBinEnv)
+	}
+	return ephemeral.dsn
+}
+
+// findPostgres returns the path of a PostgreSQL server program.
+func findPostgres(name string) (string, error) {
+	if dir := os.Getenv(postgresBinEnv); dir != "" {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	return exec.LookPath(name)
+}
+
+// startPostgres initialises a database cluster in a temporary
+// directory, and starts a server for it, listening only on a Unix
+// socket in that directory.
+func startPostgres() {
+	e := &ephemeral
+	if os.Geteuid() == 0 {
+		e.err = fmt.Errorf("the server can't be run as root")
+		return
+	}
+
+	initdb, err := findPostgres("initdb")
+	if err != nil {
+		e.err = err
+		return
+	}
+	e.ctl, err = findPostgres("pg_ctl")
+	if err != nil {
+		e.err = err
+		return
+	}
+
+	// The socket path must be short, so this isn't under the
+	// test's own temporary directory.
+	e.dir, err = ioutil.TempDir("", "liteboot-pg")
+	if err != nil {
+		e.err = err
+		return
+	}
+	data := filepath.Join(e.dir, "data")
+
+	out, err := exec.Command(initdb, "-D", data, "-U", "liteboot",
+		"-A", "trust", "-E", "UTF8", "--no-locale").CombinedOutput()
+	if err != nil {
+		e.err = fmt.Errorf("initdb: %v\n%s", err, out)
+		return
+	}
+
+	out, err = exec.Command(e.ctl, "start", "-w", "-D", data,
+		"-l", filepath.Join(e.dir, "server.log"),
+		"-o", fmt.Sprintf("-k %s -c listen_addresses=''", e.dir)).CombinedOutput()
+	if err != nil {
+		e.err = fmt.Errorf("pg_ctl start: %v\n%s", err, out)
+		return
+	}
+
+	e.dsn = fmt.Sprintf("postgres://liteboot@/postgres?host=%s&sslmode=disable", e.dir)
+}
+
+// stopPostgres stops the ephemeral server, if it was started, and
+// removes its files.
+func stopPostgres() {
+	e := &ephemeral
+	if e.dir == "" {
+		return
+	}
+	if e.dsn != "" {
+		out, err := exec.Command(e.ctl, "stop", "-w", "-m", "fast",
+			"-D", filepath.Join(e.dir, "data")).CombinedOutput()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pg_ctl stop: %v\n%s", err, out)
+		}
+	}
+	os.RemoveAll(e.dir)
+}
@@ -1,6 +1,7 @@
 package cadb
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -14,87 +15,160 @@ import (
 // unique.
 var NonUnique = errors.New("Non Unique Serial")
 
+// UnknownSerial is an error that indicates no certificate has been
+// issued with a given serial number.
+var UnknownSerial = errors.New("Unknown Serial")
+
+// AlreadyRevoked is an error that indicates the certificate with a
+// given serial number has already been revoked.
+var AlreadyRevoked = errors.New("Certificate Already Revoked")
+
+// serialBits is the size of the random serials we generate.  RFC 5280
+// limits serials to 20 octets, and they must be positive, so this
+// leaves the top bit clear.
+const serialBits = 159
+
+// serialAttempts limits how many random serials GetSerial tries.  A
+// collision is vanishingly unlikely, so repeated ones indicate a
+// broken random source.
+const serialAttempts = 8
+
 // Generate a serial number for a certificate.  The serial number is
 // required to be unique for all certificates generated by a given
-// authority.  To help with this, we will use a timestamp for the
-// signature.  We scan the database to make sure that timestamp is not
-// already taken (to protect against clock changes).
+// authority, and RFC 5280 recommends that they be unpredictable.  We
+// use a random serial, and reserve it in the database before it is
+// used, so that no two requests can be given the same one, even for
+// certificates that are never added to certs.
 func (conn *Conn) GetSerial() (*big.Int, error) {
-	for {
-		ser, err := conn.tryGetSerial()
+	limit := new(big.Int).Lsh(big.NewInt(1), serialBits)
+
+	for i := 0; i < serialAttempts; i++ {
+		ser, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return nil, err
+		}
+		if ser.Sign() == 0 {
+			continue
+		}
+
+		err = conn.reserveSerial(ser)
 		if err != NonUnique {
 			// Any other kind of error, or success
 			// returns.
 			return ser, err
 		}
-
-		// We need to sleep enough for time to have changed a
-		// bit.  Unfortunately, this would requiring knowing
-		// the granularity of the system clock.  We'll start
-		// by making an assumption that sleeping will sleep at
-		// least long enough for the queried time to have
-		// changed.
-		time.Sleep(time.Millisecond)
 	}
-}
 
-// tryGetSerial generates a serial number, based on the current clock,
-// queries the database to ensure that it hasn't been issued before.
-// If successful, err will be nil, it will return the serial number.
-// Otherwise, it will return NonUnique, for which the caller should
-// retry after a period of time.  Any other error indicates a failure
-// with one of the called routines.
-func (conn *Conn) tryGetSerial() (*big.Int, error) {
-	// We just use the time's nanosecond resolution.
-	ser := big.NewInt(time.Now().UnixNano())
+	return nil, fmt.Errorf("unable to find an unused serial after %d attempts", serialAttempts)
+}
 
-	// TODO: This should be done inside of a transaction, to
-	// prevent any kind of race caused by multiple queries.
+// reserveSerial records a serial number as used, in a single
+// statement, so that it is atomic.  Returns NonUnique if the serial
+// has already been used.
+func (conn *Conn) reserveSerial(ser *big.Int) error {
+	// The statement is run in a transaction, as SQLite takes the
+	// write lock at the start of one, waiting for other writers.
+	// On its own, the statement would upgrade a read lock, which
+	// fails at once if another connection is writing.
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
 
-	row := conn.db.QueryRow(`SELECT COUNT(*) FROM certs WHERE serial = ?`,
-		ser.String())
-	var count int
-	err := row.Scan(&count)
+	key := serialKey(ser)
+	res, err := tx.Exec(`INSERT INTO serials (serial)
+		SELECT CAST(? AS TEXT) WHERE NOT EXISTS (SELECT 1 FROM certs WHERE serial = ?)
+		ON CONFLICT DO NOTHING`, key, key)
+	var count int64
+	if err == nil {
+		count, err = res.RowsAffected()
+	}
 	if err != nil {
-		return nil, err
+		_ = tx.Rollback()
+		return err
 	}
 
-	if count != 0 {
-		return nil, NonUnique
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return NonUnique
 	}
+	return nil
+}
+
+// AddCert adds a newly generated certificate to the database.  The
+// profile is the name of the certificate profile it was issued under.
+func (conn *Conn) AddCert(id string, name string, profile string, serial *big.Int, keyId []byte, expiry time.Time, cert []byte) error {
+	return conn.addCert(id, name, profile, serial, keyId, expiry, cert, nil, nil, false)
+}
 
-	return ser, nil
+// AddDeviceCert adds the first certificate of a device that did not
+// make an initialisation request.  Returns DeviceExists if the device
+// is already in the database, so that of two requests for the same
+// device, only one succeeds.
+func (conn *Conn) AddDeviceCert(id string, name string, profile string, serial *big.Int, keyId []byte, expiry time.Time, cert []byte) error {
+	return conn.addCert(id, name, profile, serial, keyId, expiry, cert, nil, nil, true)
 }
 
-// AddCert adds a newly generated certificate to the database.
-func (conn *Conn) AddCert(id string, name string, serial *big.Int, keyId []byte, expiry time.Time, cert []byte) error {
+// AddEnrolledCert adds the first certificate of a device that made an
+// initialisation request, consuming the nonce it was given.  The nonce
+// is checked as part of adding the certificate, so it is only used up
+// if the certificate is recorded.  Returns BadChallenge if the nonce
+// does not match, or has expired.
+func (conn *Conn) AddEnrolledCert(id string, name string, profile string, serial *big.Int, keyId []byte, expiry time.Time, cert []byte, nonce []byte) error {
+	return conn.addCert(id, name, profile, serial, keyId, expiry, cert, nil, nonce, false)
+}
+
+// AddRenewedCert adds a certificate that was generated to replace the
+// certificate with serial number `replaces`.  The old certificate is
+// left valid, as the device may not have received the new one.
+func (conn *Conn) AddRenewedCert(id string, name string, profile string, serial *big.Int, keyId []byte, expiry time.Time, cert []byte, replaces *big.Int) error {
+	return conn.addCert(id, name, profile, serial, keyId, expiry, cert, replaces, nil, false)
+}
+
+func (conn *Conn) addCert(id string, name string, profile string, serial *big.Int, keyId []byte, expiry time.Time, cert []byte, replaces *big.Int, nonce []byte, newDevice bool) error {
 	tx, err := conn.db.Begin()
 	if err != nil {
 		return err
 	}
 
-	// Query the device database to see if we need to create an
-	// entry for it.
-	row := tx.QueryRow(`SELECT COUNT(*) FROM devices WHERE id = ?`, id)
-	var count int
-	err = row.Scan(&count)
+	if nonce != nil {
+		err = consumeChallenge(tx, id, nonce)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	// Create an entry for the device, unless it has one.  A new
+	// device must not have one; this is decided by the insert
+	// itself, so of two concurrent requests, only one wins.
+	res, err := tx.Exec(`INSERT INTO devices (id, registered, state) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`, id, 0, DeviceEnrolled)
+	var count int64
+	if err == nil {
+		count, err = res.RowsAffected()
+	}
 	if err != nil {
 		_ = tx.Rollback()
 		return err
 	}
+	if count == 0 && newDevice {
+		_ = tx.Rollback()
+		return DeviceExists
+	}
 
-	if count == 0 {
-		_, err = tx.Exec(`INSERT INTO devices (id, registered) VALUES (?, ?)`,
-			id, 0)
-		if err != nil {
-			_ = tx.Rollback()
-			return err
-		}
+	var prev sql.NullString
+	if replaces != nil {
+		prev.String = serialKey(replaces)
+		prev.Valid = true
 	}
 
 	// Record the certificate as associated with this device.
-	_, err = tx.Exec(`INSERT INTO certs (id, name, serial, keyid, expiry, cert, valid) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		id, name, serial.Int64(), keyId, expiry, cert, 1)
+	_, err = tx.Exec(`INSERT INTO certs (id, name, profile, serial, keyid, expiry, cert, valid, replaces) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, name, profile, serialKey(serial), keyId, expiry, cert, 1, prev)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
@@ -109,7 +183,7 @@ func (conn *Conn) GetCertBySerial(serial *big.Int) ([]byte, error) {
 	var cert []byte
 
 	if err := conn.db.QueryRow("SELECT cert FROM certs WHERE valid = 1 AND serial = ?",
-		serial.String()).Scan(&cert); err != nil {
+		serialKey(serial)).Scan(&cert); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("serial %d: unknown certificate", serial)
 		}
@@ -118,12 +192,47 @@ func (conn *Conn) GetCertBySerial(serial *big.Int) ([]byte, error) {
 	return cert, nil
 }
 
+// CertOwner returns the id of the device the certificate with the
+// given serial was issued to, the certificate itself, and whether it
+// is still valid.  Returns UnknownSerial if no such certificate has
+// been issued.
+func (conn *Conn) CertOwner(serial *big.Int) (string, []byte, bool, error) {
+	var id string
+	var cert []byte
+	var valid bool
+	err := conn.db.QueryRow(`SELECT id, cert, valid FROM certs WHERE serial = ?`,
+		serialKey(serial)).Scan(&id, &cert, &valid)
+	if err == sql.ErrNoRows {
+		return "", nil, false, UnknownSerial
+	}
+	if err != nil {
+		return "", nil, false, err
+	}
+	return id, cert, valid, nil
+}
+
+// CertProfile returns the name of the profile the certificate with
+// the given serial was issued under.  It is empty for certificates
+// issued before profiles were recorded.
+func (conn *Conn) CertProfile(serial *big.Int) (string, error) {
+	var profile sql.NullString
+
+	if err := conn.db.QueryRow("SELECT profile FROM certs WHERE serial = ?",
+		serialKey(serial)).Scan(&profile); err != nil {
+		if err == sql.ErrNoRows {
+			return "", UnknownSerial
+		}
+		return "", err
+	}
+	return profile.String, nil
+}
+
 // SerialValid checks if a valid certificate exists for the specified serial
 func (conn *Conn) SerialValid(serial *big.Int) (bool, error) {
 	var valid bool
 
 	if err := conn.db.QueryRow("SELECT valid FROM certs WHERE serial = ?",
-		serial.String()).Scan(&valid); err != nil {
+		serialKey(serial)).Scan(&valid); err != nil {
 		if err == sql.ErrNoRows {
 			return false, fmt.Errorf("serial %d: unknown certificate", serial)
 		}
@@ -146,27 +255,70 @@ func (conn *Conn) CertsByUUID(id uuid.UUID) ([]big.Int, error) {
 	var result []big.Int
 
 	for rows.Next() {
-		var serial int64
-		err = rows.Scan(&serial)
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+		serial, err := parseSerial(key)
 		if err != nil {
 			return nil, err
 		}
-		serbi := big.NewInt(int64(serial))
-		result = append(result, *serbi)
+		result = append(result, *serial)
 	}
 
-	return result, nil
+	return result, rows.Err()
+}
+
+// RevokeCert marks the certificate with the given serial as revoked,
+// recording the current time and the RFC 5280 reason code.  The
+// certificate will no longer be reported as valid.
+func (conn *Conn) RevokeCert(serial *big.Int, reason int) error {
+	// The update only applies to a certificate that isn't already
+	// revoked, so that of two concurrent requests only one
+	// succeeds, and the first time and reason are kept.
+	res, err := conn.db.Exec(`UPDATE certs
+		SET valid = 0, revoked = ?, reason = ?
+		WHERE serial = ? AND revoked IS NULL`,
+		time.Now().UTC(), reason, serialKey(serial))
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	// Find out why nothing was updated.
+	var n int
+	err = conn.db.QueryRow(`SELECT COUNT(*) FROM certs WHERE serial = ?`,
+		serialKey(serial)).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return UnknownSerial
+	}
+	return AlreadyRevoked
 }
 
 // UnregisteredDevices returns a list of devices that have not been
 // registered with the cloud.  This may need to be extended to return
 // certificate information, if we add support for a cloud service that
-// does not support signed certificates.
+// does not support signed certificates.  The ids that bootstrap and
+// server certificates are recorded under are not devices, and are
+// left out.
 func (conn *Conn) UnregisteredDevices() ([]string, error) {
 	var result []string
 
-	rows, err := conn.db.Query(`SELECT devices.id FROM certs LEFT JOIN devices
-		WHERE certs.id = devices.id AND registered = 0`)
+	rows, err := conn.db.Query(`SELECT devices.id FROM certs JOIN devices
+		ON certs.id = devices.id WHERE registered = 0
+		AND devices.id NOT IN (?, ?, ?)`,
+		BootstrapId, ServerId, OCSPSignerId)
 	if err != nil {
 		return nil, err
 	}
@@ -203,3 +355,89 @@ func (conn *Conn) MarkRegistered(device string) error {
 	err = tx.Commit()
 	return err
 }
+
+// A RevokedCert describes a certificate that has been revoked.
+type RevokedCert struct {
+	Serial  *big.Int
+	Revoked time.Time
+	Reason  int
+
+	// The certificate itself, from RevokedCerts, so that a CRL can
+	// be limited to the certificates of one CA.
+	Cert []byte
+}
+
+// RevokedCerts returns all of the certificates that have been revoked.
+func (conn *Conn) RevokedCerts() ([]RevokedCert, error) {
+	rows, err := conn.db.Query(`SELECT serial, revoked, reason, cert FROM certs
+		WHERE revoked IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []RevokedCert
+
+	for rows.Next() {
+		var key string
+		var rc RevokedCert
+		err = rows.Scan(&key, &rc.Revoked, &rc.Reason, &rc.Cert)
+		if err != nil {
+			return nil, err
+		}
+		rc.Serial, err = parseSerial(key)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rc)
+	}
+
+	return result, rows.Err()
+}
+
+// RevocationStatus returns the revocation details of the certificate
+// with the given serial, or nil if it has not been revoked.  Returns
+// UnknownSerial if no such certificate has been issued.
+func (conn *Conn) RevocationStatus(serial *big.Int) (*RevokedCert, error) {
+	var revoked sql.NullTime
+	var reason sql.NullInt64
+	err := conn.db.QueryRow(`SELECT revoked, reason FROM certs WHERE serial = ?`,
+		serialKey(serial)).Scan(&revoked, &reason)
+	if err == sql.ErrNoRows {
+		return nil, UnknownSerial
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !revoked.Valid {
+		return nil, nil
+	}
+
+	return &RevokedCert{
+		Serial:  serial,
+		Revoked: revoked.Time,
+		Reason:  int(reason.Int64),
+	}, nil
+}
+
+// NextCRLNumber returns the number to use for the next CRL, and
+// records it in the settings table, so that CRL numbers are always
+// increasing.  It is a single statement, so that concurrent callers
+// each get a different number.
+func (conn *Conn) NextCRLNumber() (*big.Int, error) {
+	var value string
+	err := conn.db.QueryRow(`INSERT INTO settings (key, value) VALUES ('crlNumber', '1')
+		ON CONFLICT (key) DO UPDATE
+		SET value = CAST(CAST(settings.value AS BIGINT) + 1 AS TEXT)
+		RETURNING value`).Scan(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	number, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid crlNumber in db: %q", value)
+	}
+	return number, nil
+}
@@ -1,6 +1,8 @@
 package cadb
 
-import "github.com/google/uuid"
+import (
+	"github.com/google/uuid"
+)
 
 // This is the schema for the database.  These statements will be
 // evaluated in order to create the initial database.
@@ -13,22 +15,64 @@ var schema = []string{
 
 	// devices holds all devices known to the system.  The id is
 	// the identifier from the CSR.  `registered` indicates that
-	// the service considers this to be a valid device.
+	// the service considers this to be a valid device.  `state`
+	// is "pending" for a device that has made an initialisation
+	// request, but not yet echoed `nonce` back in a certification
+	// request, and "enrolled" afterwards.
 	`CREATE TABLE devices (id STRING PRIMARY KEY,
-		registered INTEGER NOT NULL)`,
+		registered INTEGER NOT NULL,
+		state STRING NOT NULL,
+		hwserial STRING,
+		attestation BLOB,
+		nonce BLOB,
+		nonceexpiry DATE)`,
 
 	// certs holds all of the certificates we've ever issued.
+	// `profile` names the certificate profile it was issued
+	// under, which renewals keep.  `replaces` holds the serial of the certificate this one was
+	// issued to replace through a key update request, if any.  A
+	// revoked certificate has `valid` cleared, and records the
+	// time of revocation and the RFC 5280 reason code.  Serials
+	// are stored as lower case hex text, without leading zeros
+	// (see serialKey), as they can be up to 20 octets.
 	`CREATE TABLE certs (id STRING NOT NULL REFERENCES devices(id),
 		name STRING NOT NULL,
-		serial STRING NOT NULL,
+		profile STRING,
+		serial TEXT NOT NULL,
 		keyid BLOB NOT NULL,
 		cert BLOB NOT NULL,
 		expiry DATE NOT NULL,
 		valid INTEGER NOT NULL,
+		replaces TEXT,
+		revoked DATE,
+		reason INTEGER,
 		PRIMARY KEY (id, serial))`,
+	`CREATE UNIQUE INDEX certs_serial ON certs (serial)`,
+
+	// bootstrap holds the classes of devices that enroll with a
+	// shared bootstrap certificate, named by its OU, and the policy
+	// for them.  `profile` is the certificate profile the class
+	// enrolls under, `maxenroll` limits the number of enrollments,
+	// counted in `enrollments`, with NULL for no limit, and no
+	// enrollments are accepted after `expiry`.  A revoked class is
+	// refused altogether.  The certificates themselves are in certs,
+	// under the id "bootstrap", named by class.
+	`CREATE TABLE bootstrap (class STRING PRIMARY KEY,
+		profile STRING,
+		maxenroll INTEGER,
+		enrollments INTEGER NOT NULL,
+		expiry DATE NOT NULL,
+		revoked INTEGER NOT NULL)`,
+
+	// serials holds every serial number that has been handed out
+	// by GetSerial, whether or not the certificate was then added
+	// to certs, so that none is used twice.
+	`CREATE TABLE serials (serial TEXT PRIMARY KEY)`,
 }
 
-const schemaVersion = "20220215a"
+// schemaVersion is the version of the schema above.  Existing
+// databases are brought up to it by the migrations in migrate.go.
+const schemaVersion = "20261017g"
 
 func (conn *Conn) checkSchema() error {
 	// Query the settings table for the schema version.
@@ -45,8 +89,7 @@ func (conn *Conn) checkSchema() error {
 		return nil
 	}
 
-	panic("TODO: Implement database upgrades")
-	return nil
+	return conn.migrate(version)
 }
 
 // setSchema installs the above database schema into the connected
@@ -58,7 +101,7 @@ func (conn *Conn) setSchema() error {
 	}
 
 	for _, item := range schema {
-		_, err = tx.Exec(item)
+		_, err = tx.Exec(tx.dialect.ddl(item))
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -0,0 +1,22 @@
+package cadb
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// serialKey returns the form a serial number is stored in the
+// database: lower case hex, without leading zeros.  Serials may be up
+// to 20 octets, too large for an SQL integer.
+func serialKey(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+// parseSerial parses a serial number stored by serialKey.
+func parseSerial(key string) (*big.Int, error) {
+	serial, ok := new(big.Int).SetString(key, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial in db: %q", key)
+	}
+	return serial, nil
+}
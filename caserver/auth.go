@@ -0,0 +1,159 @@
+package caserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/google/uuid"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
+	"github.com/plgd-dev/go-coap/v2/mux"
+)
+
+// Clients authenticate with either a bootstrap certificate, shared by
+// a class of devices, or a device certificate we issued through an
+// enrollment.  Each endpoint permits one or both.  Device
+// certificates may only be used for requests about their own device.
+// Bootstrap certificates are shared by a whole class of devices, so
+// they may query any device, but not change one without a proof that
+// they hold its key.
+
+// A peerRole is the kind of certificate a client authenticated with.
+type peerRole int
+
+const (
+	roleBootstrap peerRole = 1 << iota
+	roleDevice
+
+	roleAny = roleBootstrap | roleDevice
+)
+
+// errForbidden indicates a request that the client's certificate does
+// not permit.
+var errForbidden = errors.New("request not permitted for this certificate")
+
+// A peer is a client that has authenticated with a certificate.
+type peer struct {
+	role peerRole
+	cert *x509.Certificate
+
+	// For a device certificate, the id of the device.
+	device string
+}
+
+// identifyPeer checks a client certificate against the database, and
+// returns the kind of client it identifies.  A device certificate
+// must be one we issued, to a device, and not revoked.  Certificates
+// that aren't recorded are bootstrap certificates from earlier
+// versions, checked by checkBootstrap.
+func identifyPeer(crt *x509.Certificate) (*peer, error) {
+	if crt == nil {
+		return nil, fmt.Errorf("Expecting a client certificate")
+	}
+
+	id, stored, valid, err := db.CertOwner(crt.SerialNumber)
+	switch {
+	case err == cadb.UnknownSerial || (err == nil && id == cadb.BootstrapId):
+		err = checkBootstrap(crt)
+		if err != nil {
+			return nil, err
+		}
+		return &peer{role: roleBootstrap, cert: crt}, nil
+	case err != nil:
+		return nil, err
+	case !bytes.Equal(stored, crt.Raw):
+		return nil, fmt.Errorf("Client certificate %s does not match our records", crt.SerialNumber)
+	case !valid:
+		return nil, fmt.Errorf("Client certificate %s has been revoked", crt.SerialNumber)
+	}
+
+	// Devices are named by UUID, which sets them apart from the
+	// certificates the server issues for itself.
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fmt.Errorf("Invalid client certificate")
+	}
+	return &peer{role: roleDevice, cert: crt, device: id}, nil
+}
+
+// ownsDevice returns true if the peer authenticated with a device
+// certificate of the device `id`.  Requests that change a device, such
+// as revoking or replacing its certificates, need this, or else some
+// other proof of control, such as a signature by the device's key.
+func (p *peer) ownsDevice(id string) bool {
+	return p.role == roleDevice && strings.EqualFold(p.device, id)
+}
+
+// ownsSerial returns true if the peer authenticated with a device
+// certificate, and the certificate with the given serial was issued to
+// its device.
+func (p *peer) ownsSerial(serial *big.Int) bool {
+	if p.role != roleDevice {
+		return false
+	}
+	id, _, _, err := db.CertOwner(serial)
+	return err == nil && strings.EqualFold(id, p.device)
+}
+
+// mayQueryDevice returns true if the peer may ask about the status of
+// the device `id`.  Bootstrap certificates may ask about any device.
+func (p *peer) mayQueryDevice(id string) bool {
+	return p.role == roleBootstrap || p.ownsDevice(id)
+}
+
+// mayQuerySerial returns true if the peer may fetch the certificate with
+// the given serial.  Bootstrap certificates may fetch any certificate.
+func (p *peer) mayQuerySerial(serial *big.Int) bool {
+	return p.role == roleBootstrap || p.ownsSerial(serial)
+}
+
+type peerKey struct{}
+
+// requestPeer returns the client of a request, as identified by
+// allow.
+func requestPeer(r *http.Request) *peer {
+	p, _ := r.Context().Value(peerKey{}).(*peer)
+	return p
+}
+
+// allow wraps a handler so that it is only served to clients with one
+// of the given roles.
+func allow(roles peerRole, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := identifyPeer(peerCert(r))
+		if err == nil && p.role&roles == 0 {
+			err = errForbidden
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "` + errForbidden.Error() + `"}`))
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), peerKey{}, p)))
+	}
+}
+
+// coapPeer returns the client of a CoAP request.
+func coapPeer(w mux.ResponseWriter) (*peer, error) {
+	return identifyPeer(coapPeerCert(w))
+}
+
+// coapAllow wraps a CoAP handler so that it is only served to clients
+// with one of the given roles.
+func coapAllow(roles peerRole, h mux.HandlerFunc) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, r *mux.Message) {
+		p, err := coapPeer(w)
+		if err != nil || p.role&roles == 0 {
+			coapError(w, codes.Forbidden, errForbidden.Error())
+			return
+		}
+		h(w, r)
+	}
+}
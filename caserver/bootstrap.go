@@ -0,0 +1,102 @@
+package caserver
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+)
+
+// bootstrapClass returns the class in the database that a bootstrap
+// certificate belongs to, by its OU.  Returns nil for a certificate
+// whose class isn't recorded, such as one made by the setup scripts
+// of earlier versions.
+func bootstrapClass(bootstrap *x509.Certificate) (*cadb.BootstrapClass, error) {
+	ou := bootstrapOU(bootstrap)
+	if ou == "" {
+		return nil, nil
+	}
+	return db.GetBootstrapClass(ou)
+}
+
+// checkBootstrap checks that a client certificate is a bootstrap
+// certificate that may still be used.  Its class must not have been
+// revoked or expired, nor the certificate itself revoked.  A
+// certificate whose class isn't recorded is accepted by its OU alone,
+// if that is the standard one, or one mapped to a profile.
+func checkBootstrap(crt *x509.Certificate) error {
+	class, err := bootstrapClass(crt)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case class == nil:
+		if !isBootstrapOU(bootstrapOU(crt)) {
+			return fmt.Errorf("Invalid client certificate")
+		}
+	case class.Revoked:
+		return fmt.Errorf("Bootstrap class %q has been revoked", class.Name)
+	case time.Now().After(class.Expiry):
+		return fmt.Errorf("Bootstrap class %q has expired", class.Name)
+	}
+
+	revoked, err := db.CertRevoked(crt.SerialNumber)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return fmt.Errorf("Bootstrap certificate %s has been revoked", crt.SerialNumber)
+	}
+
+	return nil
+}
+
+// classProfile returns the profile name for enrollments with a
+// bootstrap certificate, from the policy of its class, or else from
+// `[profilemap]`, if any.
+func classProfile(bootstrap *x509.Certificate) (string, bool, error) {
+	class, err := bootstrapClass(bootstrap)
+	if err != nil {
+		return "", false, err
+	}
+	if class != nil && class.Profile != "" {
+		return class.Profile, true, nil
+	}
+
+	name, ok := mappedProfile(bootstrapOU(bootstrap))
+	return name, ok, nil
+}
+
+// consumeEnrollment counts a new enrollment against the class of a
+// bootstrap certificate.  Returns the name of the class, which should
+// be passed to releaseEnrollment if the enrollment then fails, or ""
+// if the class isn't recorded.
+func consumeEnrollment(bootstrap *x509.Certificate) (string, error) {
+	class, err := bootstrapClass(bootstrap)
+	if err != nil || class == nil {
+		return "", err
+	}
+
+	err = db.ConsumeEnrollment(class.Name)
+	if err == cadb.EnrollmentLimit {
+		return "", newPolicyError(protocol.PolicyEnrollmentLimit,
+			"bootstrap class %q has no enrollments remaining", class.Name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return class.Name, nil
+}
+
+// releaseEnrollment returns an enrollment counted by consumeEnrollment.
+func releaseEnrollment(class string) {
+	if class == "" {
+		return
+	}
+	if err := db.ReleaseEnrollment(class); err != nil {
+		fmt.Printf("Release enrollment error: %v\n", err)
+	}
+}
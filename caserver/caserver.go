@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -14,9 +15,12 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 
 	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/datadir"
 	"github.com/Linaro/lite_bootstrap_server/protocol"
+	"github.com/Linaro/lite_bootstrap_server/signer"
 	"github.com/fxamacker/cbor/v2"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -26,13 +30,79 @@ import (
 // The database itself.
 // TODO: Should this be a context instead of a global?
 var db *cadb.Conn
+var dbOnce sync.Once
+
+// openDB opens the database, once, for whichever server starts first.
+func openDB() {
+	dbOnce.Do(func() {
+		var err error
+		db, err = cadb.Open()
+		if err != nil {
+			log.Fatal("Unable to open CA database")
+		}
+	})
+}
 
 // Initialisation request handler
 func irPost(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"message": "ir POST called"}
-{"serial": "Device serial number"}`))
+	use_cbor := false
+	switch r.Header.Get("Content-Type") {
+	case "application/cbor":
+		use_cbor = true
+	case "application/json":
+	case "":
+		// Default to JSON if not Content-Type provided (curl, etc.)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Bad request: Content-Type must be application/cbor or application/json"}`))
+		return
+	}
+
+	var err error
+	var req protocol.IRRequest
+	if use_cbor {
+		dec := cbor.NewDecoder(r.Body)
+		err = dec.Decode(&req)
+	} else {
+		dec := json.NewDecoder(r.Body)
+		err = dec.Decode(&req)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Bad request: POST data did not match specified Content-Type"}`))
+		return
+	}
+
+	nonce, err := handleIR(&req)
+	if err == cadb.DeviceExists {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error": "device already exists"}`))
+		return
+	}
+	if err != nil {
+		writeRequestError(w, use_cbor, err)
+		return
+	}
+
+	if use_cbor {
+		w.Header().Set("Content-Type", "application/cbor")
+		w.WriteHeader(http.StatusOK)
+		enc := cbor.NewEncoder(w)
+		err = enc.Encode(&protocol.IRResponse{
+			Status: 0,
+			Nonce:  nonce,
+		})
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		err = enc.Encode(&protocol.IRResponse{
+			Status: 0,
+			Nonce:  nonce,
+		})
+	}
 }
 
 // Certification request handler
@@ -69,14 +139,18 @@ func crPost(w http.ResponseWriter, r *http.Request) {
 
 	// fmt.Printf("Got csr: %v\n", &req)
 
-	cert, err := handleCSR(req.CSR)
+	cert, err := handleCSR(req.CSR, req.Nonce, peerCert(r), r.URL.Query().Get("profile"))
+	if err == errEnrollment {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": "Forbidden: missing or invalid initialisation challenge"}`))
+		return
+	}
 	if err != nil {
-		// TODO: Encode the error.
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "err: %v", err)
+		writeRequestError(w, use_cbor, err)
 		return
 	}
 
+	chain := issuerChain()
 	if use_cbor {
 		w.Header().Set("Content-Type", "application/cbor")
 		w.WriteHeader(http.StatusOK)
@@ -84,6 +158,7 @@ func crPost(w http.ResponseWriter, r *http.Request) {
 		err = enc.Encode(&protocol.CSRResponse{
 			Status: 0,
 			Cert:   cert,
+			Chain:  chain,
 		})
 	} else {
 		w.Header().Set("Content-Type", "application/json")
@@ -92,6 +167,7 @@ func crPost(w http.ResponseWriter, r *http.Request) {
 		err = enc.Encode(&protocol.CSRResponse{
 			Status: 0,
 			Cert:   cert,
+			Chain:  chain,
 		})
 	}
 }
@@ -166,23 +242,38 @@ func p10crPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A device that made an initialisation request passes the nonce
+	// as a hex encoded "nonce" form field.
+	var nonce []byte
+	if val := r.FormValue("nonce"); val != "" {
+		nonce, err = hex.DecodeString(val)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "Invalid nonce"}`))
+			return
+		}
+	}
+
 	// Process the CSR and register the certificate details
-	cert, err := handleCSR(pemin.Bytes)
+	cert, err := handleCSR(pemin.Bytes, nonce, peerCert(r), r.FormValue("profile"))
+	if err == errEnrollment {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": "Forbidden: missing or invalid initialisation challenge"}`))
+		return
+	}
 	if err != nil {
-		// TODO: Encode the error.
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "Invalid CSR"}`))
+		writeRequestError(w, false, err)
 		return
 	}
 
-	// Convert DER output to PEM
-	pemout := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	// Convert DER output to PEM, followed by the issuer chain
+	pemout := pemChain(cert)
 
 	// Set the file response details
 	// MIME type = application/x-x509-user-cert or application/x-pem-file ?
 	w.Header().Set("Content-Disposition", "attachment; filename=USERx.der")
 	w.Header().Set("Content-Type", "application/x-pem-file")
-	w.Header().Set("Content-Length", string(len(pemout)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(pemout)))
 	io.Copy(w, bytes.NewReader(pemout))
 }
 
@@ -280,13 +371,18 @@ func dsGet(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if !requestPeer(r).mayQueryDevice(devid.String()) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": "` + errForbidden.Error() + `"}`))
+		return
+	}
 
 	// Check UUID for valid certs
 	serials, err := db.CertsByUUID(devid)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(`{"error": "unable to query db for UUID"}`))
-		log.Fatal("DB error: %s\n", err)
+		log.Printf("DB error: %s\n", err)
 		return
 	}
 
@@ -329,27 +425,148 @@ func dsGet(w http.ResponseWriter, r *http.Request) {
 }
 
 // Key update request handler
+//
+// This generates a new certificate for this client, based on the
+// information from the existing certificate.  This does _not_
+// invalidate or revoke the old certificate, as something such as an
+// untimely power loss would cause the new key to be lost.  The old
+// certificate is fine to use until it expires.
 func kurPost(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"message": "kur POST called"}`))
-
-	// TODO: Validate current cert status and update/regen if necessary
-	// This should generate a new certificate for this client,
-	// based on the information from the existing certificate.
-	// This should _not_ invalidate or revoke the old certificate,
-	// as something such as an untimely power loss would cause the
-	// new key to be lost.  The old certificate is fine to use
-	// until it expires.
+	use_cbor := false
+	switch r.Header.Get("Content-Type") {
+	case "application/cbor":
+		use_cbor = true
+	case "application/json":
+	case "":
+		// Default to JSON if not Content-Type provided (curl, etc.)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Bad request: Content-Type must be application/cbor or application/json"}`))
+		return
+	}
+
+	var err error
+	var req protocol.KURRequest
+	if use_cbor {
+		w.Header().Set("Content-Type", "application/cbor")
+		dec := cbor.NewDecoder(r.Body)
+		err = dec.Decode(&req)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		dec := json.NewDecoder(r.Body)
+		err = dec.Decode(&req)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Bad request: POST data did not match specified Content-Type"}`))
+		return
+	}
+
+	cert, err := handleKUR(&req, requestPeer(r))
+	if err == errKURAuth {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": "Forbidden: certificate is not valid for key update"}`))
+		return
+	}
+	if err != nil {
+		writeRequestError(w, use_cbor, err)
+		return
+	}
+
+	chain := issuerChain()
+	if use_cbor {
+		w.WriteHeader(http.StatusOK)
+		enc := cbor.NewEncoder(w)
+		err = enc.Encode(&protocol.CSRResponse{
+			Status: 0,
+			Cert:   cert,
+			Chain:  chain,
+		})
+	} else {
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		err = enc.Encode(&protocol.CSRResponse{
+			Status: 0,
+			Cert:   cert,
+			Chain:  chain,
+		})
+	}
 }
 
-// Key revocation request
+// Key revocation request handler
 func krrPost(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"message": "krr POST called"}`))
+	use_cbor := false
+	switch r.Header.Get("Content-Type") {
+	case "application/cbor":
+		use_cbor = true
+	case "application/json":
+	case "":
+		// Default to JSON if not Content-Type provided (curl, etc.)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Bad request: Content-Type must be application/cbor or application/json"}`))
+		return
+	}
 
-	// TODO: Mark certificate as revoked in the DB
+	var err error
+	var req protocol.KRRRequest
+	if use_cbor {
+		dec := cbor.NewDecoder(r.Body)
+		err = dec.Decode(&req)
+	} else {
+		dec := json.NewDecoder(r.Body)
+		err = dec.Decode(&req)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Bad request: POST data did not match specified Content-Type"}`))
+		return
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		log.Printf("Revocation request from %v\n", r.TLS.PeerCertificates[0].Subject)
+	}
+
+	err = handleKRR(&req, requestPeer(r))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		switch err {
+		case errForbidden:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "` + errForbidden.Error() + `"}`))
+		case errBadReason:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "unsupported revocation reason"}`))
+		case cadb.UnknownSerial:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid serial number"}`))
+		case cadb.AlreadyRevoked:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "certificate already revoked"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error": "unable to update db"}`))
+			log.Printf("DB error: %s\n", err)
+		}
+		return
+	}
+
+	if use_cbor {
+		w.Header().Set("Content-Type", "application/cbor")
+		w.WriteHeader(http.StatusOK)
+		enc := cbor.NewEncoder(w)
+		err = enc.Encode(&protocol.KRRResponse{
+			Status: 0,
+		})
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		err = enc.Encode(&protocol.KRRResponse{
+			Status: 0,
+		})
+	}
 }
 
 // Test endpoint: https://localhost/api/v1/ccs
@@ -395,6 +612,36 @@ func ccsGet(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// writePolicyError reports a request rejected by the issuance policy,
+// with the reason code in the body.
+func writePolicyError(w http.ResponseWriter, use_cbor bool, perr *policyError) {
+	writeErrorResponse(w, use_cbor, http.StatusBadRequest, perr.Response())
+}
+
+// writeRequestError reports a request that failed.  A rejection gets a
+// 400 with its reason code, and any other error, which is the server's
+// own, a 500 with only a generic description.
+func writeRequestError(w http.ResponseWriter, use_cbor bool, err error) {
+	if perr, ok := err.(*policyError); ok {
+		writePolicyError(w, use_cbor, perr)
+		return
+	}
+	writeErrorResponse(w, use_cbor, http.StatusInternalServerError, internalError(err))
+}
+
+func writeErrorResponse(w http.ResponseWriter, use_cbor bool, status int, rsp *protocol.ErrorResponse) {
+	if use_cbor {
+		w.Header().Set("Content-Type", "application/cbor")
+		w.WriteHeader(status)
+		cbor.NewEncoder(w).Encode(rsp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rsp)
+}
+
 // REST API catch all handler
 func notFound(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -434,6 +681,11 @@ func ccGet(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`{"error": "invalid request"}`))
 		return
 	}
+	if !requestPeer(r).mayQuerySerial(ser) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": "` + errForbidden.Error() + `"}`))
+		return
+	}
 
 	cert, err := db.GetCertBySerial(ser)
 	if err != nil {
@@ -443,8 +695,8 @@ func ccGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Convert DER output to PEM
-	pemout := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	// Convert DER output to PEM, followed by the issuer chain
+	pemout := pemChain(cert)
 
 	// CBOR response handler
 	if use_cbor {
@@ -468,46 +720,65 @@ func ccGet(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Start the HTTP Server
-func Start(hostname string, port int16) {
-	var err error
-	db, err = cadb.Open()
-	if err != nil {
-		log.Fatal("Unable to open CADB.db database")
-	}
+// Start the HTTP Server.  If pubport is non-zero, a plain HTTP server
+// is also started on that port, to publish the CRL and answer OCSP
+// requests from relying parties that have no client certificate.
+func Start(hostname string, port int16, pubport int16) {
+	openDB()
 
 	// go registration()
 
-	// Create a certificate pool with the CA certificate.
-	certPool := x509.NewCertPool()
-	caCert, err := ioutil.ReadFile("certs/CA.crt")
+	if pubport != 0 {
+		go startPublic(hostname, pubport)
+	}
+
+	// Create a certificate pool with the CA certificate, and during a
+	// rollover, the CA it is rolling over to or from.
+	certPool, err := signer.TrustPool(caBase())
 	if err != nil {
 		log.Fatal(err)
 	}
-	certPool.AppendCertsFromPEM(caCert)
 
 	r := mux.NewRouter()
 
 	// Setup the REST API subrouter
 	api := r.PathPrefix("/api/v1").Subrouter()
-	api.HandleFunc("/cr", crPost).Methods(http.MethodPost)
-	api.HandleFunc("/p10cr", p10crPost).Methods(http.MethodPost)
-	api.HandleFunc("/cs/{serial}", csGet).Methods(http.MethodGet)
-	api.HandleFunc("/ds/{uuid}", dsGet).Methods(http.MethodGet)
-	api.HandleFunc("/kur", kurPost).Methods(http.MethodPost)
-	api.HandleFunc("/krr", krrPost).Methods(http.MethodPost)
-	api.HandleFunc("/ccs", ccsGet).Methods(http.MethodGet)
-	api.HandleFunc("/cc/{serial}", ccGet).Methods(http.MethodGet)
+	api.HandleFunc("/ir", allow(roleBootstrap, irPost)).Methods(http.MethodPost)
+	api.HandleFunc("/cr", allow(roleBootstrap, crPost)).Methods(http.MethodPost)
+	api.HandleFunc("/p10cr", allow(roleBootstrap, p10crPost)).Methods(http.MethodPost)
+	api.HandleFunc("/cs/{serial}", allow(roleAny, csGet)).Methods(http.MethodGet)
+	api.HandleFunc("/ds/{uuid}", allow(roleAny, dsGet)).Methods(http.MethodGet)
+	api.HandleFunc("/kur", allow(roleAny, kurPost)).Methods(http.MethodPost)
+	api.HandleFunc("/krr", allow(roleAny, krrPost)).Methods(http.MethodPost)
+	api.HandleFunc("/ccs", allow(roleAny, ccsGet)).Methods(http.MethodGet)
+	api.HandleFunc("/cc/{serial}", allow(roleAny, ccGet)).Methods(http.MethodGet)
+	api.HandleFunc("/crl", allow(roleAny, crlGet)).Methods(http.MethodGet)
+	api.HandleFunc("/crl/{keyid}", allow(roleAny, crlGet)).Methods(http.MethodGet)
+	api.HandleFunc("/trust", allow(roleAny, trustGet)).Methods(http.MethodGet)
 	api.HandleFunc("", notFound)
 
+	// Enrollment over Secure Transport, authenticated in the same
+	// way as the REST API.
+	addESTRoutes(r)
+
+	// The OCSP responder.  GET requests carry base64 data in the
+	// path, which must not be cleaned.
+	r.SkipClean(true)
+	r.PathPrefix("/ocsp").HandlerFunc(allow(roleAny, ocspHandler)).
+		Methods(http.MethodGet, http.MethodPost)
+
 	// Handle standard requests. Routes are tested in the order they are added,
 	// so these will only be handled if they don't match anything above.
 	r.HandleFunc("/", home)
 
 	// Make sure the server key and certificate exist
-	if !fileExists("certs/SERVER.key") || !fileExists("certs/SERVER.crt") {
+	if !fileExists(datadir.Certs("SERVER.key")) || !fileExists(datadir.Certs("SERVER.crt")) {
 		log.Fatal("Server certificate and key not found. See README.md.")
 	}
+	cert, err := serverCertificate()
+	if err != nil {
+		log.Fatal("Server certificate: ", err)
+	}
 
 	server := &http.Server{
 		Addr:    hostname + ":" + strconv.Itoa(int(port)),
@@ -517,7 +788,8 @@ func Start(hostname string, port int16) {
 		// server, but we can request/verify that there is a
 		// valid client cert specified.
 		TLSConfig: &tls.Config{
-			ClientAuth: tls.RequireAndVerifyClientCert,
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
 
 			ClientCAs:             certPool,
 			VerifyPeerCertificate: validatePeer,
@@ -526,30 +798,81 @@ func Start(hostname string, port int16) {
 
 	fmt.Println("Starting CA server on https://" + hostname + ":" +
 		strconv.Itoa(int(port)))
-	err = server.ListenAndServeTLS("certs/SERVER.crt", "certs/SERVER.key")
+	err = server.ListenAndServeTLS("", "")
 	if err != nil {
 		log.Fatal("ListenAndServeTLS: ", err)
 	}
 }
 
+// startPublic starts the plain HTTP server for unauthenticated
+// requests.  Only signed objects are served here.
+func startPublic(hostname string, port int16) {
+	r := mux.NewRouter()
+
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/crl", crlGet).Methods(http.MethodGet)
+	api.HandleFunc("/crl/{keyid}", crlGet).Methods(http.MethodGet)
+	api.HandleFunc("/trust", trustGet).Methods(http.MethodGet)
+	api.HandleFunc("", notFound)
+
+	r.SkipClean(true)
+	r.PathPrefix("/ocsp").HandlerFunc(ocspHandler).
+		Methods(http.MethodGet, http.MethodPost)
+
+	r.HandleFunc("/", home)
+
+	addr := hostname + ":" + strconv.Itoa(int(port))
+	fmt.Println("Starting public server on http://" + addr)
+	err := http.ListenAndServe(addr, r)
+	if err != nil {
+		log.Fatal("ListenAndServe: ", err)
+	}
+}
+
+// peerCert returns the client certificate of a request, if any.
+func peerCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
 // ValidatePeer checks the given certificates and makes sure they are
 // appropriate for requests from the bootstrap service.
 func validatePeer(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-	if len(verifiedChains) != 1 {
-		return fmt.Errorf("Expecting a single certificate chain")
+	// During a CA rollover, a client sending a cross certificate may
+	// chain to both CAs.
+	if len(verifiedChains) == 0 {
+		return fmt.Errorf("Expecting a verified certificate chain")
 	}
 
 	// TODO: We should probably verify the certificate chain ends
 	// with our CA, but that should always be the case.  In this
-	// case, just verify the subject has an OU of "LinaroCA
-	// Bootstrap Cert".
+	// case, just verify it is a bootstrap certificate that hasn't
+	// been shut off, or a device certificate that is still valid.
+	// Each endpoint checks which of these it permits.
 	//log.Printf("cert: %#v", verifiedChains[0][0].Subject)
-	crt := verifiedChains[0][0]
-	if len(crt.Subject.OrganizationalUnit) != 1 || crt.Subject.OrganizationalUnit[0] != "LinaroCA Bootstrap Cert" {
-		return fmt.Errorf("Invalid client certificate")
+	_, err := identifyPeer(verifiedChains[0][0])
+	return err
+}
+
+// serverCertificate loads the server certificate and key.  When the
+// CA is an issuing CA below a root, the certificates above the server
+// certificate are sent with it, if SERVER.crt doesn't already hold
+// them, so that devices that only trust the root can build the chain.
+func serverCertificate() (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(datadir.Certs("SERVER.crt"), datadir.Certs("SERVER.key"))
+	if err != nil {
+		return cert, err
 	}
 
-	return nil
+	if len(cert.Certificate) == 1 {
+		chain := issuerChain()
+		if len(chain) > 1 {
+			cert.Certificate = append(cert.Certificate, chain...)
+		}
+	}
+	return cert, nil
 }
 
 func fileExists(filename string) bool {
@@ -0,0 +1,437 @@
+package caserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+	piondtls "github.com/pion/dtls/v2"
+	"github.com/plgd-dev/go-coap/v2/dtls"
+	"github.com/plgd-dev/go-coap/v2/message"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
+	"github.com/plgd-dev/go-coap/v2/mux"
+	coapNet "github.com/plgd-dev/go-coap/v2/net"
+	"github.com/plgd-dev/go-coap/v2/udp/client"
+	"github.com/spf13/viper"
+)
+
+// The CoAP transport offers the same resources as the REST API, for
+// constrained devices.  Requests and responses are always CBOR, using
+// the same structures from the protocol package, and clients
+// authenticate with their bootstrap certificate during the DTLS
+// handshake.
+
+// codeConflict is 4.09 Conflict (RFC 8132), which go-coap doesn't
+// define.
+const codeConflict codes.Code = 137
+
+// coapError sends a plain text error response.
+func coapError(w mux.ResponseWriter, code codes.Code, msg string) {
+	err := w.SetResponse(code, message.TextPlain, bytes.NewReader([]byte(msg)))
+	if err != nil {
+		log.Printf("coap: cannot set response: %v\n", err)
+	}
+}
+
+// coapRequestError reports a request that failed, as writeRequestError
+// does over HTTP: a rejection gets 4.00 with its reason code, and
+// other errors 5.00 with only a generic description.
+func coapRequestError(w mux.ResponseWriter, err error) {
+	if perr, ok := err.(*policyError); ok {
+		coapReply(w, codes.BadRequest, perr.Response())
+		return
+	}
+	coapReply(w, codes.InternalServerError, internalError(err))
+}
+
+// coapReply encodes `rsp` as CBOR and sends it with the given code.
+func coapReply(w mux.ResponseWriter, code codes.Code, rsp interface{}) {
+	data, err := cbor.Marshal(rsp)
+	if err != nil {
+		coapError(w, codes.InternalServerError, "unable to encode response")
+		return
+	}
+	err = w.SetResponse(code, message.AppCBOR, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("coap: cannot set response: %v\n", err)
+	}
+}
+
+// coapDecode checks the request is a CBOR POST and decodes its body
+// into `req`.  On failure, an error response has already been sent.
+func coapDecode(w mux.ResponseWriter, r *mux.Message, req interface{}) bool {
+	if r.Code != codes.POST {
+		coapError(w, codes.MethodNotAllowed, "method not allowed")
+		return false
+	}
+	if cf, err := r.Options.ContentFormat(); err == nil && cf != message.AppCBOR {
+		coapError(w, codes.UnsupportedMediaType, "Content-Format must be application/cbor")
+		return false
+	}
+	if r.Body == nil {
+		coapError(w, codes.BadRequest, "missing payload")
+		return false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = cbor.Unmarshal(body, req)
+	}
+	if err != nil {
+		coapError(w, codes.BadRequest, "payload is not a valid request")
+		return false
+	}
+	return true
+}
+
+// coapGet checks the request is a GET.  On failure, an error response
+// has already been sent.
+func coapGet(w mux.ResponseWriter, r *mux.Message) bool {
+	if r.Code != codes.GET {
+		coapError(w, codes.MethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+// coapSerial parses the serial number from the request path.
+func coapSerial(w mux.ResponseWriter, r *mux.Message) (*big.Int, bool) {
+	ser, ok := new(big.Int).SetString(r.RouteParams.Vars["serial"], 10)
+	if !ok {
+		coapError(w, codes.BadRequest, "invalid request")
+		return nil, false
+	}
+	return ser, true
+}
+
+// coapPeerKey is the context key for the client certificate of a DTLS
+// connection.
+type coapPeerKey struct{}
+
+// coapPeerCert returns the client certificate of the connection a
+// request arrived on.
+func coapPeerCert(w mux.ResponseWriter) *x509.Certificate {
+	cert, _ := w.Client().Context().Value(coapPeerKey{}).(*x509.Certificate)
+	return cert
+}
+
+// coapQuery returns the value of a `name=value` URI-Query option.
+func coapQuery(r *mux.Message, name string) string {
+	queries, err := r.Options.Queries()
+	if err != nil {
+		return ""
+	}
+	for _, q := range queries {
+		if strings.HasPrefix(q, name+"=") {
+			return q[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// Initialisation request over CoAP
+func coapIR(w mux.ResponseWriter, r *mux.Message) {
+	var req protocol.IRRequest
+	if !coapDecode(w, r, &req) {
+		return
+	}
+
+	nonce, err := handleIR(&req)
+	if err == cadb.DeviceExists {
+		coapError(w, codeConflict, "device already exists")
+		return
+	}
+	if err != nil {
+		coapRequestError(w, err)
+		return
+	}
+
+	coapReply(w, codes.Changed, &protocol.IRResponse{
+		Status: 0,
+		Nonce:  nonce,
+	})
+}
+
+// Certificate request over CoAP
+func coapCR(w mux.ResponseWriter, r *mux.Message) {
+	var req protocol.CSRRequest
+	if !coapDecode(w, r, &req) {
+		return
+	}
+
+	cert, err := handleCSR(req.CSR, req.Nonce, coapPeerCert(w), coapQuery(r, "profile"))
+	if err == errEnrollment {
+		coapError(w, codes.Forbidden, "missing or invalid initialisation challenge")
+		return
+	}
+	if err != nil {
+		coapRequestError(w, err)
+		return
+	}
+
+	coapReply(w, codes.Changed, &protocol.CSRResponse{
+		Status: 0,
+		Cert:   cert,
+		Chain:  issuerChain(),
+	})
+}
+
+// Certificate status over CoAP
+func coapCS(w mux.ResponseWriter, r *mux.Message) {
+	if !coapGet(w, r) {
+		return
+	}
+	ser, ok := coapSerial(w, r)
+	if !ok {
+		return
+	}
+
+	valid, err := db.SerialValid(ser)
+	if err != nil {
+		coapError(w, codes.BadRequest, "invalid serial number")
+		return
+	}
+
+	var valint int
+	if valid {
+		valint = 1
+	}
+	coapReply(w, codes.Content, &protocol.CertStatusResponse{
+		Status: valint,
+	})
+}
+
+// Device status over CoAP
+func coapDS(w mux.ResponseWriter, r *mux.Message) {
+	if !coapGet(w, r) {
+		return
+	}
+	devid, err := uuid.Parse(r.RouteParams.Vars["uuid"])
+	if err != nil {
+		coapError(w, codes.BadRequest, "need a valid UUID")
+		return
+	}
+	if p, err := coapPeer(w); err != nil || !p.mayQueryDevice(devid.String()) {
+		coapError(w, codes.Forbidden, errForbidden.Error())
+		return
+	}
+
+	serials, err := db.CertsByUUID(devid)
+	if err != nil {
+		coapError(w, codes.InternalServerError, "unable to query db for UUID")
+		log.Printf("DB error: %s\n", err)
+		return
+	}
+
+	status := 0
+	if serials != nil {
+		status = 1
+	}
+	coapReply(w, codes.Content, &protocol.DevStatusResponse{
+		Status:  status,
+		Serials: serials,
+	})
+}
+
+// Certificate copy over CoAP
+func coapCC(w mux.ResponseWriter, r *mux.Message) {
+	if !coapGet(w, r) {
+		return
+	}
+	ser, ok := coapSerial(w, r)
+	if !ok {
+		return
+	}
+	if p, err := coapPeer(w); err != nil || !p.mayQuerySerial(ser) {
+		coapError(w, codes.Forbidden, errForbidden.Error())
+		return
+	}
+
+	cert, err := db.GetCertBySerial(ser)
+	if err != nil {
+		coapError(w, codes.NotFound, "invalid serial number")
+		return
+	}
+
+	pemout := pemChain(cert)
+	coapReply(w, codes.Content, &protocol.CCResponse{
+		Status: 0,
+		Cert:   string(pemout),
+	})
+}
+
+// Cloud connection settings over CoAP
+func coapCCS(w mux.ResponseWriter, r *mux.Message) {
+	if !coapGet(w, r) {
+		return
+	}
+	coapReply(w, codes.Content, &protocol.CCSResponse{
+		Hubname: viper.GetString("server.hubname"),
+		Port:    viper.GetInt("server.mqttport"),
+	})
+}
+
+// Key update request over CoAP
+func coapKUR(w mux.ResponseWriter, r *mux.Message) {
+	var req protocol.KURRequest
+	if !coapDecode(w, r, &req) {
+		return
+	}
+
+	p, err := coapPeer(w)
+	if err != nil {
+		coapError(w, codes.Forbidden, errForbidden.Error())
+		return
+	}
+
+	cert, err := handleKUR(&req, p)
+	if err == errKURAuth {
+		coapError(w, codes.Forbidden, "certificate or signature not accepted")
+		return
+	}
+	if err != nil {
+		coapRequestError(w, err)
+		return
+	}
+
+	coapReply(w, codes.Changed, &protocol.CSRResponse{
+		Status: 0,
+		Cert:   cert,
+		Chain:  issuerChain(),
+	})
+}
+
+// Key revocation request over CoAP
+func coapKRR(w mux.ResponseWriter, r *mux.Message) {
+	var req protocol.KRRRequest
+	if !coapDecode(w, r, &req) {
+		return
+	}
+
+	p, err := coapPeer(w)
+	if err != nil {
+		coapError(w, codes.Forbidden, errForbidden.Error())
+		return
+	}
+
+	err = handleKRR(&req, p)
+	switch err {
+	case nil:
+	case errForbidden:
+		coapError(w, codes.Forbidden, err.Error())
+		return
+	case errBadReason:
+		coapError(w, codes.BadRequest, "unsupported revocation reason")
+		return
+	case cadb.UnknownSerial, cadb.AlreadyRevoked:
+		coapError(w, codes.BadRequest, err.Error())
+		return
+	default:
+		coapError(w, codes.InternalServerError, "unable to update db")
+		log.Printf("DB error: %s\n", err)
+		return
+	}
+
+	coapReply(w, codes.Changed, &protocol.KRRResponse{
+		Status: 0,
+	})
+}
+
+// Trust bundle over CoAP, as an array of DER certificates
+func coapTrust(w mux.ResponseWriter, r *mux.Message) {
+	if !coapGet(w, r) {
+		return
+	}
+
+	bundle, err := trustBundle()
+	if err != nil {
+		log.Printf("trust: %v\n", err)
+		coapError(w, codes.InternalServerError, "unable to load CA certificates")
+		return
+	}
+	coapReply(w, codes.Content, bundle)
+}
+
+// coapConfig returns the DTLS configuration of the CoAP server.
+// Clients must present a bootstrap or device certificate, as with the
+// HTTPS server.
+func coapConfig() (*piondtls.Config, error) {
+	certPool, err := signer.TrustPool(caBase())
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := serverCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("Server certificate and key not found. See README.md.")
+	}
+
+	return &piondtls.Config{
+		Certificates:          []tls.Certificate{cert},
+		ClientAuth:            piondtls.RequireAndVerifyClientCert,
+		ClientCAs:             certPool,
+		VerifyPeerCertificate: validatePeer,
+		ExtendedMasterSecret:  piondtls.RequireExtendedMasterSecret,
+	}, nil
+}
+
+// newCoAPServer returns a CoAP server for the API resources.
+func newCoAPServer() *dtls.Server {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/ir", coapAllow(roleBootstrap, coapIR))
+	r.HandleFunc("/api/v1/cr", coapAllow(roleBootstrap, coapCR))
+	r.HandleFunc("/api/v1/cs/{serial}", coapAllow(roleAny, coapCS))
+	r.HandleFunc("/api/v1/ds/{uuid}", coapAllow(roleAny, coapDS))
+	r.HandleFunc("/api/v1/cc/{serial}", coapAllow(roleAny, coapCC))
+	r.HandleFunc("/api/v1/ccs", coapAllow(roleAny, coapCCS))
+	r.HandleFunc("/api/v1/kur", coapAllow(roleAny, coapKUR))
+	r.HandleFunc("/api/v1/krr", coapAllow(roleAny, coapKRR))
+	r.HandleFunc("/api/v1/trust", coapAllow(roleAny, coapTrust))
+
+	return dtls.NewServer(dtls.WithMux(r),
+		dtls.WithOnNewClientConn(func(cc *client.ClientConn, conn *piondtls.Conn) {
+			// Keep the client certificate for the handlers.
+			peers := conn.ConnectionState().PeerCertificates
+			if len(peers) == 0 {
+				return
+			}
+			cert, err := x509.ParseCertificate(peers[0])
+			if err == nil {
+				cc.SetContextValue(coapPeerKey{}, cert)
+			}
+		}))
+}
+
+// StartCoAP starts the CoAP server on DTLS.
+func StartCoAP(hostname string, port int16) {
+	openDB()
+
+	config, err := coapConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	addr := hostname + ":" + strconv.Itoa(int(port))
+	l, err := coapNet.NewDTLSListener("udp", addr, config)
+	if err != nil {
+		log.Fatal("CoAP listen: ", err)
+	}
+	defer l.Close()
+
+	fmt.Println("Starting CoAP server on coaps://" + addr)
+	err = newCoAPServer().Serve(l)
+	if err != nil {
+		log.Fatal("CoAP serve: ", err)
+	}
+}
@@ -0,0 +1,273 @@
+package caserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/datadir"
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+	piondtls "github.com/pion/dtls/v2"
+	"github.com/plgd-dev/go-coap/v2/dtls"
+	"github.com/plgd-dev/go-coap/v2/message"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
+	coapNet "github.com/plgd-dev/go-coap/v2/net"
+	"github.com/plgd-dev/go-coap/v2/udp/client"
+	"github.com/spf13/viper"
+)
+
+// newTestCA sets up a data directory with a new CA, server certificate
+// and database, as `liteboot init` would, and opens the database for
+// the handlers.  Returns the CA.
+func newTestCA(t *testing.T) *signer.SigningCert {
+	viper.Reset()
+	viper.Set("datadir", t.TempDir())
+	t.Cleanup(viper.Reset)
+	err := os.Mkdir(datadir.Path("certs"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := signer.NewSigningCert(signer.DefaultSigningCertOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ca.Export(datadir.Certs("CA.crt"), datadir.Certs("CA.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := cadb.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = conn
+	t.Cleanup(func() { db = saved })
+
+	ser, err := db.GetSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ca.NewServerCert(ser, "localhost", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddCert("server", "localhost", "", ser, server.Cert.SubjectKeyId,
+		server.Cert.NotAfter, server.CertBin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Export(datadir.Certs("SERVER.crt"), datadir.Certs("SERVER.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca
+}
+
+// newTestBootstrap issues and records a bootstrap certificate of the
+// standard class.
+func newTestBootstrap(t *testing.T, ca *signer.SigningCert) *signer.SigningCert {
+	ser, err := db.GetSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	boot, err := ca.NewBootstrapCert(ser, pkix.Name{
+		OrganizationalUnit: []string{BootstrapOU},
+		CommonName:         "test bootstrap",
+	}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddCert(cadb.BootstrapId, BootstrapOU, "", ser, boot.Cert.SubjectKeyId,
+		boot.Cert.NotAfter, boot.CertBin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return boot
+}
+
+// startTestCoAP serves the CoAP API on a loopback port, until the test
+// finishes, and returns its address.
+func startTestCoAP(t *testing.T) string {
+	config, err := coapConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := coapNet.NewDTLSListener("udp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newCoAPServer()
+	done := make(chan struct{})
+	go func() {
+		s.Serve(l)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		s.Stop()
+		l.Close()
+		<-done
+	})
+
+	return l.Addr().String()
+}
+
+// dialTestCoAP connects to the CoAP server with the given client
+// certificate.
+func dialTestCoAP(t *testing.T, addr string, ca, cert *signer.SigningCert) *client.ClientConn {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	cc, err := dtls.Dial(addr, &piondtls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{cert.CertBin},
+			PrivateKey:  cert.PrivateKey,
+		}},
+		RootCAs:              roots,
+		ServerName:           "localhost",
+		ExtendedMasterSecret: piondtls.RequireExtendedMasterSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+// coapPost sends a CBOR request, and decodes a CBOR response into
+// `rsp`, if the response has the wanted code.
+func coapPost(t *testing.T, cc *client.ClientConn, path string, req, rsp interface{}, want codes.Code) {
+	data, err := cbor.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	msg, err := cc.Post(ctx, path, message.AppCBOR, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	coapCheck(t, "POST "+path, msg.Code(), msg.Body(), rsp, want)
+}
+
+// coapCheck checks the code of a response, and decodes its body into
+// `rsp`, if any.
+func coapCheck(t *testing.T, what string, code codes.Code, body io.Reader, rsp interface{}, want codes.Code) {
+	var buf bytes.Buffer
+	if body != nil {
+		buf.ReadFrom(body)
+	}
+	if code != want {
+		t.Fatalf("%s: %v %q; want %v", what, code, buf.Bytes(), want)
+	}
+	if rsp != nil {
+		err := cbor.Unmarshal(buf.Bytes(), rsp)
+		if err != nil {
+			t.Fatalf("%s: cannot decode response: %v", what, err)
+		}
+	}
+}
+
+func TestCoAPEnrollment(t *testing.T) {
+	ca := newTestCA(t)
+	boot := newTestBootstrap(t, ca)
+	cc := dialTestCoAP(t, startTestCoAP(t), ca, boot)
+
+	var errRsp protocol.ErrorResponse
+	coapPost(t, cc, "/api/v1/ir", &protocol.IRRequest{ID: "device-1", HWSerial: "hw-1"},
+		&errRsp, codes.BadRequest)
+	if errRsp.Code != protocol.PolicyBadDeviceID {
+		t.Errorf("IR with bad ID: code %d; want %d", errRsp.Code, protocol.PolicyBadDeviceID)
+	}
+
+	id := uuid.New().String()
+	ir := &protocol.IRRequest{ID: id, HWSerial: "hw-1"}
+	var irRsp protocol.IRResponse
+	coapPost(t, cc, "/api/v1/ir", ir, &irRsp, codes.Changed)
+	if len(irRsp.Nonce) != nonceSize {
+		t.Fatalf("IR nonce of %d bytes; want %d", len(irRsp.Nonce), nonceSize)
+	}
+
+	// The device must echo the nonce.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: id},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coapPost(t, cc, "/api/v1/cr", &protocol.CSRRequest{CSR: csr}, nil, codes.Forbidden)
+
+	var crRsp protocol.CSRResponse
+	coapPost(t, cc, "/api/v1/cr", &protocol.CSRRequest{CSR: csr, Nonce: irRsp.Nonce},
+		&crRsp, codes.Changed)
+	cert, err := x509.ParseCertificate(crRsp.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != id {
+		t.Errorf("certificate CN %q; want %q", cert.Subject.CommonName, id)
+	}
+	if err = cert.CheckSignatureFrom(ca.Cert); err != nil {
+		t.Errorf("certificate not signed by the CA: %v", err)
+	}
+
+	// Once enrolled, the device can't be initialised again.
+	coapPost(t, cc, "/api/v1/ir", ir, nil, codeConflict)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	msg, err := cc.Get(ctx, "/api/v1/ds/"+id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ds protocol.DevStatusResponse
+	coapCheck(t, "GET ds", msg.Code(), msg.Body(), &ds, codes.Content)
+	if ds.Status != 1 || len(ds.Serials) != 1 {
+		t.Errorf("device status %d with %d serials; want 1 with 1", ds.Status, len(ds.Serials))
+	}
+}
+
+func TestCoAPDeviceRole(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTestCoAP(t)
+
+	// A device certificate the server issued may not initialise
+	// devices, which needs a bootstrap certificate.
+	id := uuid.New().String()
+	ser, err := db.GetSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := ca.NewBootstrapCert(ser, pkix.Name{CommonName: id}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddCert(id, "", DefaultProfile, ser, dev.Cert.SubjectKeyId,
+		dev.Cert.NotAfter, dev.CertBin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc := dialTestCoAP(t, addr, ca, dev)
+	ir := &protocol.IRRequest{ID: uuid.New().String(), HWSerial: "hw-2"}
+	coapPost(t, cc, "/api/v1/ir", ir, nil, codes.Forbidden)
+}
@@ -0,0 +1,206 @@
+package caserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// The default time between a CRL being issued and the next update.
+const DefaultCRLValidity = 24 * time.Hour
+
+// GenerateCRL builds a CRL of the certificates issued by `sig` that
+// have been revoked in the database, signed by `sig`.  Revoked
+// certificates that can't be traced to their CA, as they have no
+// authority key identifier, are listed in every CRL.  Each call
+// consumes a new CRL number.
+func GenerateCRL(conn *cadb.Conn, sig *signer.SigningCert, validity time.Duration) ([]byte, error) {
+	revoked, err := conn.RevokedCerts()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, rc := range revoked {
+		if !issuedBy(rc.Cert, sig.Cert) {
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   rc.Serial,
+			RevocationTime: rc.Revoked,
+			ReasonCode:     rc.Reason,
+		})
+	}
+
+	number, err := conn.NextCRLNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	return sig.SignCRL(entries, number, now, now.Add(validity))
+}
+
+// issuedBy returns false if the DER certificate was issued by a CA
+// other than `ca`.
+func issuedBy(der []byte, ca *x509.Certificate) bool {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil || len(cert.AuthorityKeyId) == 0 {
+		return true
+	}
+	return bytes.Equal(cert.AuthorityKeyId, ca.SubjectKeyId)
+}
+
+// crlPath returns the path, under the API, of the CRL of the CA with
+// the given certificate.  CAs are named by their key identifier, which
+// stays the same as they move through a rollover.
+func crlPath(ca *x509.Certificate) string {
+	return "/api/v1/crl/" + hex.EncodeToString(ca.SubjectKeyId)
+}
+
+// crlValidity returns the configured time until a CRL's nextUpdate.
+func crlValidity() time.Duration {
+	validity := viper.GetDuration("crl.nextupdate")
+	if validity <= 0 {
+		validity = DefaultCRLValidity
+	}
+	return validity
+}
+
+// The most recently generated CRL of each CA is cached, by its key
+// identifier, and is regenerated once half of its validity has
+// passed, or after a revocation.
+var crlCache struct {
+	sync.Mutex
+	crls map[string]*cachedCRL
+}
+
+type cachedCRL struct {
+	der     []byte
+	refresh time.Time
+}
+
+// invalidateCRL causes the next CRL request to generate a new CRL.
+func invalidateCRL() {
+	crlCache.Lock()
+	crlCache.crls = nil
+	crlCache.Unlock()
+}
+
+// errUnknownCA indicates a CRL request for a CA we don't hold.
+var errUnknownCA = errors.New("unknown CA")
+
+// crlIssuer returns the base name and certificate of the CA with the
+// given hex key identifier, among those of a rollover, or of the CA
+// issuing now if `keyid` is empty.
+func crlIssuer(keyid string) (string, *x509.Certificate, error) {
+	if keyid == "" {
+		base, err := signer.IssuerBase(caBase())
+		if err != nil {
+			return "", nil, err
+		}
+		cert, err := signer.LoadCert(base + ".crt")
+		return base, cert, err
+	}
+
+	for _, base := range caBases() {
+		cert, err := signer.LoadCert(base + ".crt")
+		if err != nil {
+			return "", nil, err
+		}
+		if strings.EqualFold(hex.EncodeToString(cert.SubjectKeyId), keyid) {
+			return base, cert, nil
+		}
+	}
+	return "", nil, errUnknownCA
+}
+
+// currentCRL returns the cached CRL of the CA with the given hex key
+// identifier, or of the CA issuing now, generating a new one if
+// needed.
+func currentCRL(keyid string) ([]byte, error) {
+	base, cert, err := crlIssuer(keyid)
+	if err != nil {
+		return nil, err
+	}
+	key := hex.EncodeToString(cert.SubjectKeyId)
+
+	crlCache.Lock()
+	defer crlCache.Unlock()
+
+	if c := crlCache.crls[key]; c != nil && time.Now().Before(c.refresh) {
+		return c.der, nil
+	}
+
+	sig, err := signer.LoadSigningCert(base)
+	if err != nil {
+		return nil, err
+	}
+
+	validity := crlValidity()
+	der, err := GenerateCRL(db, sig, validity)
+	if err != nil {
+		return nil, err
+	}
+
+	if crlCache.crls == nil {
+		crlCache.crls = make(map[string]*cachedCRL)
+	}
+	crlCache.crls[key] = &cachedCRL{
+		der:     der,
+		refresh: time.Now().Add(validity / 2),
+	}
+	return der, nil
+}
+
+// Certificate revocation list handler.  The CRL of the CA issuing now
+// is returned, or with a key identifier in the path, that of the CA
+// of a rollover with that key.  The CRL is returned in DER form, or in
+// PEM form with `?format=pem`.
+func crlGet(w http.ResponseWriter, r *http.Request) {
+	der, err := currentCRL(mux.Vars(r)["keyid"])
+	if err == errUnknownCA {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "unknown CA"}`))
+		return
+	}
+	if err != nil {
+		log.Printf("crl: %v\n", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "unable to generate CRL"}`))
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "der":
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Header().Set("Content-Length", strconv.Itoa(len(der)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(der)
+	case "pem":
+		pemout := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Length", strconv.Itoa(len(pemout)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(pemout)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "format must be der or pem"}`))
+	}
+}
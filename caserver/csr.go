@@ -1,47 +1,129 @@
 package caserver
 
 import (
+	"bytes"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"log"
-	"time"
+	"math/big"
+	"strings"
 
-	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/protocol"
 )
 
+// publicURL is the base URL of the public HTTP server, used for the
+// CRL distribution point and OCSP responder in issued certificates.
+// They are left out when it is empty.
+var publicURL string
+
+// SetPublicURL sets the base URL, such as "http://ca.example.com:8080",
+// under which the CRL and OCSP responder are published.
+func SetPublicURL(url string) {
+	publicURL = strings.TrimSuffix(url, "/")
+}
+
 // handleCSR processes an incoming CSR, and if valid, builds a
-// certificate for the device.
-func handleCSR(asn1Data []byte) ([]byte, error) {
+// certificate for the device.  The nonce is the challenge from the
+// device's initialisation request, or nil if it didn't make one.  The
+// certificate profile is chosen from the bootstrap certificate the
+// request was made with, and the profile name the device requested,
+// if any.  The enrollment is counted against the class of the
+// bootstrap certificate.
+func handleCSR(asn1Data []byte, nonce []byte, bootstrap *x509.Certificate, requested string) ([]byte, error) {
 	csr, err := x509.ParseCertificateRequest(asn1Data)
 	if err != nil {
 		fmt.Printf("Error: %s\n", err)
-		return nil, err
+		return nil, newPolicyError(protocol.PolicyBadCSR, "CSR is invalid: %v", err)
 	}
 	log.Printf("Received CSR: %v\n", csr.Subject)
 
-	// TODO: Need to validate all of the information from the
-	// certificate request.
+	err = checkSubject(csr.Subject)
+	if err != nil {
+		return nil, err
+	}
+	err = checkRequest(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	prof, err := selectProfile(bootstrap, requested)
+	if err != nil {
+		return nil, err
+	}
+	err = prof.checkKey(csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The challenge is only checked here, so that a request refused
+	// above leaves it for the device to try again.  It is consumed
+	// along with recording the certificate.
+	err = checkEnrollment(csr.Subject.CommonName, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	class, err := consumeEnrollment(bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := issueCert(csr.Subject, csr.PublicKey, prof, nil, nonce)
+	if err != nil {
+		releaseEnrollment(class)
+		return nil, err
+	}
+	return cert, nil
+}
+
+// issueCert builds, signs and records a certificate for the given
+// subject and public key, under the given profile.  If `replaces` is
+// non-nil, the new certificate is recorded as a replacement for the
+// certificate with that serial number.  If `nonce` is non-nil, it is
+// the device's initialisation challenge, which is consumed as the
+// certificate is recorded.
+func issueCert(subject pkix.Name, pub interface{}, prof *Profile, replaces *big.Int, nonce []byte) ([]byte, error) {
+	err := prof.checkKey(pub)
+	if err != nil {
+		return nil, err
+	}
 
 	ser, err := db.GetSerial()
+	if err != nil {
+		return nil, err
+	}
 
-	expiry := time.Now().AddDate(1, 0, 0)
-	cert := &x509.Certificate{
-		SerialNumber: ser,
-		Subject:      csr.Subject,
-		NotBefore:    time.Now(),
-		NotAfter:     expiry,
-		// TODO: Extensions that make sense to us.
+	cert, err := prof.template(ser, subject)
+	if err != nil {
+		return nil, err
 	}
 
-	signedCert, err := signCert(cert, csr.PublicKey)
+	signedCert, err := signCert(cert, pub)
 	if err != nil {
 		fmt.Printf("Sign error: %v\n", err)
 		return nil, err
 	}
 
+	// The OU names the kind of certificate, and may be absent.
 	id := cert.Subject.CommonName
-	name := cert.Subject.OrganizationalUnit[0]
-	err = db.AddCert(id, name, ser, cert.SubjectKeyId, expiry, signedCert)
+	name := ""
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		name = cert.Subject.OrganizationalUnit[0]
+	}
+	switch {
+	case replaces != nil:
+		err = db.AddRenewedCert(id, name, prof.Name, ser, cert.SubjectKeyId, cert.NotAfter, signedCert, replaces)
+	case nonce != nil:
+		err = db.AddEnrolledCert(id, name, prof.Name, ser, cert.SubjectKeyId, cert.NotAfter, signedCert, nonce)
+	default:
+		err = db.AddDeviceCert(id, name, prof.Name, ser, cert.SubjectKeyId, cert.NotAfter, signedCert)
+	}
+	if err == cadb.BadChallenge || err == cadb.DeviceExists {
+		return nil, errEnrollment
+	}
 	if err != nil {
 		fmt.Printf("Add cert err: %v\n", err)
 		return nil, err
@@ -50,16 +132,43 @@ func handleCSR(asn1Data []byte) ([]byte, error) {
 	return signedCert, nil
 }
 
+// issuerChain returns the certificates of the issuing CA, and any CAs
+// above it, nearest first.  These are returned to devices along with
+// their certificates.
+func issuerChain() [][]byte {
+	sig, err := loadIssuer()
+	if err != nil {
+		log.Printf("Unable to load CA chain: %v\n", err)
+		return nil
+	}
+	return sig.FullChain()
+}
+
+// pemChain encodes a certificate followed by its issuer chain in PEM
+// form.
+func pemChain(cert []byte) []byte {
+	var buf bytes.Buffer
+	for _, c := range append([][]byte{cert}, issuerChain()...) {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	return buf.Bytes()
+}
+
 func signCert(template *x509.Certificate, pub interface{}) ([]byte, error) {
 	// TODO: Don't use hardcoded names here.
 	// TODO: This can probably share a bit of code with the root
 	// cert generation.
 
-	sig, err := signer.LoadSigningCert("certs/CA")
+	sig, err := loadIssuer()
 	if err != nil {
 		return nil, err
 	}
 
+	template.AuthorityKeyId = sig.Cert.SubjectKeyId
+	if publicURL != "" {
+		template.CRLDistributionPoints = []string{publicURL + crlPath(sig.Cert)}
+	}
+
 	cert, err := sig.SignTemplate(template, pub)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,114 @@
+package caserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Linaro/lite_bootstrap_server/datadir"
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/google/uuid"
+)
+
+// newTestCSR returns a CSR for the device with a new key.
+func newTestCSR(t *testing.T, id string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: id},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+// postJSON sends a JSON request to a handler as the client with the
+// given certificate, and returns the response.
+func postJSON(t *testing.T, h http.HandlerFunc, client *signer.SigningCert, req interface{}) *httptest.ResponseRecorder {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.Cert}}
+
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestCROfEnrolledDevice(t *testing.T) {
+	ca := newTestCA(t)
+	boot := newTestBootstrap(t, ca)
+	cr := allow(roleBootstrap, crPost)
+
+	// Without `server.requireir`, a new device may enroll in one
+	// step.
+	id := uuid.New().String()
+	w := postJSON(t, cr, boot, &protocol.CSRRequest{CSR: newTestCSR(t, id)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cr of new device: %d %s", w.Code, w.Body)
+	}
+
+	// But a bootstrap certificate can't get a certificate for a
+	// device that has already enrolled.
+	w = postJSON(t, cr, boot, &protocol.CSRRequest{CSR: newTestCSR(t, id)})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("second cr of enrolled device: %d %s; want %d", w.Code, w.Body, http.StatusForbidden)
+	}
+	serials, err := db.CertsByUUID(uuid.MustParse(id))
+	if err != nil || len(serials) != 1 {
+		t.Errorf("device has %d certificates, %v; want 1", len(serials), err)
+	}
+
+	// Nor for a device that is pending, without its nonce.
+	id = uuid.New().String()
+	w = postJSON(t, allow(roleBootstrap, irPost), boot, &protocol.IRRequest{ID: id, HWSerial: "hw-1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("ir: %d %s", w.Code, w.Body)
+	}
+	w = postJSON(t, cr, boot, &protocol.CSRRequest{CSR: newTestCSR(t, id)})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("cr of pending device without nonce: %d %s; want %d", w.Code, w.Body, http.StatusForbidden)
+	}
+}
+
+func TestCRInternalError(t *testing.T) {
+	ca := newTestCA(t)
+	boot := newTestBootstrap(t, ca)
+
+	// Without the CA key, nothing can be signed.  That is the
+	// server's fault, and its details aren't for the client.
+	err := os.Remove(datadir.Certs("CA.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := postJSON(t, allow(roleBootstrap, crPost), boot,
+		&protocol.CSRRequest{CSR: newTestCSR(t, uuid.New().String())})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("cr: %d %s; want %d", w.Code, w.Body, http.StatusInternalServerError)
+	}
+	var rsp protocol.ErrorResponse
+	err = json.Unmarshal(w.Body.Bytes(), &rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Code != protocol.InternalError || rsp.Error != "internal error" {
+		t.Errorf("cr: %+v; want code %d and a generic description", rsp, protocol.InternalError)
+	}
+}
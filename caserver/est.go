@@ -0,0 +1,398 @@
+package caserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+	"github.com/gorilla/mux"
+)
+
+// Enrollment over Secure Transport (RFC 7030).  These handlers are a
+// front end to the same issuance path as the `cr` endpoint, for use
+// by off the shelf EST clients.
+
+var (
+	oidData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidChallengePassword    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+	oidECPublicKey          = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidRSAEncryption        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidEd25519              = asn1.ObjectIdentifier{1, 3, 101, 112}
+	oidSignatureSHA256RSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSignatureECDSASHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSignatureECDSASHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidSignatureECDSASHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+// The named curves a profile may permit, by their Go names, with the
+// signature algorithm that goes with each.
+var estCurves = map[string]struct {
+	curve, sigAlg asn1.ObjectIdentifier
+}{
+	"P-256": {asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}, oidSignatureECDSASHA256},
+	"P-384": {asn1.ObjectIdentifier{1, 3, 132, 0, 34}, oidSignatureECDSASHA384},
+	"P-521": {asn1.ObjectIdentifier{1, 3, 132, 0, 35}, oidSignatureECDSASHA512},
+}
+
+// errReenroll indicates a re-enrollment request whose subject does not
+// match the certificate being replaced.
+var errReenroll = errors.New("subject does not match the current certificate")
+
+// certsOnly encodes the given DER certificates as a degenerate
+// PKCS#7 SignedData, with no content or signers.
+func certsOnly(certs ...[]byte) ([]byte, error) {
+	type encapContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+	}
+	type signedData struct {
+		Version          int
+		DigestAlgorithms []asn1.RawValue `asn1:"set"`
+		ContentInfo      encapContentInfo
+		Certificates     asn1.RawValue
+		SignerInfos      []asn1.RawValue `asn1:"set"`
+	}
+	type contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}
+
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []asn1.RawValue{},
+		ContentInfo:      encapContentInfo{ContentType: oidData},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      bytes.Join(certs, nil),
+		},
+		SignerInfos: []asn1.RawValue{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      sd,
+		},
+	})
+}
+
+// challengePassword returns the challengePassword attribute of a CSR,
+// if it has one.  EST clients use this to carry the nonce from an
+// initialisation request.
+func challengePassword(csr *x509.CertificateRequest) (string, bool) {
+	var tbs struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []struct {
+			Type   asn1.ObjectIdentifier
+			Values []asn1.RawValue `asn1:"set"`
+		} `asn1:"tag:0,set"`
+	}
+	_, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs)
+	if err != nil {
+		return "", false
+	}
+
+	for _, attr := range tbs.Attributes {
+		if !attr.Type.Equal(oidChallengePassword) || len(attr.Values) != 1 {
+			continue
+		}
+		var password string
+		_, err = asn1.Unmarshal(attr.Values[0].FullBytes, &password)
+		if err != nil {
+			return "", false
+		}
+		return password, true
+	}
+	return "", false
+}
+
+// readESTBody reads a base64 encoded DER body, as sent by EST clients.
+// Bodies that are already DER are also accepted.
+func readESTBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_CSR_UPLOAD_SIZE))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > 0 && body[0] == 0x30 {
+		return body, nil
+	}
+
+	body = bytes.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, body)
+	return base64.StdEncoding.DecodeString(string(body))
+}
+
+// writePKCS7 writes a certs-only response, base64 encoded.
+func writePKCS7(w http.ResponseWriter, certs ...[]byte) {
+	p7, err := certsOnly(certs...)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to encode response\n"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.WriteHeader(http.StatusOK)
+	w.Write(base64Lines(p7))
+}
+
+// base64Lines encodes data as base64, broken into 64 character lines.
+func base64Lines(data []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(data)
+
+	var buf bytes.Buffer
+	for len(enc) > 64 {
+		buf.WriteString(enc[:64])
+		buf.WriteString("\r\n")
+		enc = enc[64:]
+	}
+	buf.WriteString(enc)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// estError writes a plain text error response.
+func estError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", msg)
+}
+
+// EST CA certificates handler.  During a rollover, this includes the
+// new CA and the cross certificates, as RFC 7030 section 4.1.3 asks.
+func estCACertsGet(w http.ResponseWriter, r *http.Request) {
+	bundle, err := trustBundle()
+	if err != nil {
+		log.Printf("est: %v\n", err)
+		estError(w, http.StatusInternalServerError, "Unable to load CA certificate")
+		return
+	}
+
+	writePKCS7(w, bundle...)
+}
+
+// EST CSR attributes handler.  This tells clients the key types and
+// signature algorithms that the profile their CSR will be checked
+// against permits.
+func estCSRAttrsGet(w http.ResponseWriter, r *http.Request) {
+	prof, err := csrAttrsProfile(requestPeer(r), r.URL.Query().Get("profile"))
+	if perr, ok := err.(*policyError); ok {
+		estError(w, http.StatusBadRequest, fmt.Sprintf("policy %d: %s", perr.code, perr.msg))
+		return
+	}
+	if err != nil {
+		log.Printf("est: %v\n", err)
+		estError(w, http.StatusInternalServerError, "Unable to select profile")
+		return
+	}
+
+	attrs, err := csrAttrs(prof)
+	if err != nil {
+		estError(w, http.StatusInternalServerError, "Unable to encode attributes")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/csrattrs")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.WriteHeader(http.StatusOK)
+	w.Write(base64Lines(attrs))
+}
+
+// csrAttrsProfile returns the profile a client's next CSR is checked
+// against: for a device, that of its current certificate, as it would
+// re-enroll, and otherwise the one chosen for its bootstrap
+// certificate.
+func csrAttrsProfile(p *peer, requested string) (*Profile, error) {
+	if p.role == roleDevice {
+		return renewalProfile(p.cert.SerialNumber)
+	}
+	return selectProfile(p.cert, requested)
+}
+
+// csrAttrs encodes the CsrAttrs of RFC 7030 section 4.5.2 for a
+// profile.  ECDSA is described by an attribute listing the permitted
+// curves, and the other key types by their OIDs, each preceded by the
+// signature algorithm to use.
+func csrAttrs(prof *Profile) ([]byte, error) {
+	type attribute struct {
+		Type   asn1.ObjectIdentifier
+		Values []asn1.ObjectIdentifier `asn1:"set"`
+	}
+
+	var items []interface{}
+	for _, alg := range prof.KeyAlgorithms {
+		switch alg {
+		case "ecdsa":
+			var curves []asn1.ObjectIdentifier
+			for _, name := range prof.Curves {
+				c, ok := estCurves[name]
+				if !ok {
+					continue
+				}
+				items = append(items, c.sigAlg)
+				curves = append(curves, c.curve)
+			}
+			if len(curves) > 0 {
+				items = append(items, attribute{
+					Type:   oidECPublicKey,
+					Values: curves,
+				})
+			}
+		case "rsa":
+			items = append(items, oidSignatureSHA256RSA, oidRSAEncryption)
+		case "ed25519":
+			items = append(items, oidEd25519)
+		}
+	}
+
+	values := make([]asn1.RawValue, 0, len(items))
+	for _, item := range items {
+		der, err := asn1.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, asn1.RawValue{FullBytes: der})
+	}
+	return asn1.Marshal(values)
+}
+
+// EST simple enrollment handler
+func estSimpleEnrollPost(w http.ResponseWriter, r *http.Request) {
+	der, err := readESTBody(w, r)
+	if err != nil {
+		estError(w, http.StatusBadRequest, "Invalid PKCS#10 request")
+		return
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		estError(w, http.StatusBadRequest, "Invalid PKCS#10 request")
+		return
+	}
+
+	// A device that made an initialisation request passes the
+	// nonce, in hex, as the challengePassword.
+	var nonce []byte
+	if password, ok := challengePassword(csr); ok {
+		nonce, err = hex.DecodeString(password)
+		if err != nil {
+			estError(w, http.StatusBadRequest, "Invalid challengePassword")
+			return
+		}
+	}
+
+	cert, err := handleCSR(der, nonce, peerCert(r), r.URL.Query().Get("profile"))
+	if err == errEnrollment {
+		estError(w, http.StatusForbidden, "Missing or invalid initialisation challenge")
+		return
+	}
+	if perr, ok := err.(*policyError); ok {
+		estError(w, http.StatusBadRequest, fmt.Sprintf("policy %d: %s", perr.code, perr.msg))
+		return
+	}
+	if err != nil {
+		log.Printf("est: %v\n", err)
+		estError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	writePKCS7(w, append([][]byte{cert}, issuerChain()...)...)
+}
+
+// EST simple re-enrollment handler.  The client must authenticate with
+// the device certificate to be replaced.
+func estSimpleReenrollPost(w http.ResponseWriter, r *http.Request) {
+	der, err := readESTBody(w, r)
+	if err != nil {
+		estError(w, http.StatusBadRequest, "Invalid PKCS#10 request")
+		return
+	}
+
+	cert, err := handleReenroll(der, requestPeer(r))
+	if err == errForbidden {
+		estError(w, http.StatusForbidden, "Not permitted to re-enroll this device")
+		return
+	}
+	if err == errReenroll {
+		estError(w, http.StatusBadRequest, "Subject does not match the current certificate")
+		return
+	}
+	if perr, ok := err.(*policyError); ok {
+		estError(w, http.StatusBadRequest, fmt.Sprintf("policy %d: %s", perr.code, perr.msg))
+		return
+	}
+	if err != nil {
+		log.Printf("est: %v\n", err)
+		estError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	writePKCS7(w, append([][]byte{cert}, issuerChain()...)...)
+}
+
+// handleReenroll issues a replacement for the device certificate the
+// client authenticated with, as RFC 7030 section 4.2.2 describes.  The
+// CSR must carry the same subject as that certificate, which the new
+// certificate keeps, and is recorded as replacing it.
+func handleReenroll(der []byte, p *peer) ([]byte, error) {
+	if p == nil || p.role != roleDevice {
+		return nil, errForbidden
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, newPolicyError(protocol.PolicyBadCSR, "CSR is invalid: %v", err)
+	}
+	err = checkRequest(csr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received EST re-enroll: %v (serial %s)\n", csr.Subject, p.cert.SerialNumber)
+
+	old := p.cert
+	if csr.Subject.String() != old.Subject.String() {
+		return nil, errReenroll
+	}
+
+	prof, err := renewalProfile(old.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	return issueCert(old.Subject, csr.PublicKey, prof, old.SerialNumber, nil)
+}
+
+// addESTRoutes adds the EST endpoints to the given router.
+func addESTRoutes(r *mux.Router) {
+	est := r.PathPrefix("/.well-known/est").Subrouter()
+	est.HandleFunc("/cacerts", allow(roleAny, estCACertsGet)).Methods(http.MethodGet)
+	est.HandleFunc("/csrattrs", allow(roleAny, estCSRAttrsGet)).Methods(http.MethodGet)
+	est.HandleFunc("/simpleenroll", allow(roleBootstrap, estSimpleEnrollPost)).Methods(http.MethodPost)
+	est.HandleFunc("/simplereenroll", allow(roleDevice, estSimpleReenrollPost)).Methods(http.MethodPost)
+}
@@ -0,0 +1,88 @@
+package caserver
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// decodeCSRAttrs decodes CsrAttrs into strings, an OID as itself, and
+// an attribute as its type followed by its values.
+func decodeCSRAttrs(t *testing.T, der []byte) []string {
+	var values []asn1.RawValue
+	rest, err := asn1.Unmarshal(der, &values)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("CsrAttrs: %v, %d bytes left", err, len(rest))
+	}
+
+	var attrs []string
+	for _, v := range values {
+		if v.Tag == asn1.TagOID {
+			var oid asn1.ObjectIdentifier
+			_, err = asn1.Unmarshal(v.FullBytes, &oid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attrs = append(attrs, oid.String())
+			continue
+		}
+
+		var attr struct {
+			Type   asn1.ObjectIdentifier
+			Values []asn1.ObjectIdentifier `asn1:"set"`
+		}
+		_, err = asn1.Unmarshal(v.FullBytes, &attr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs = append(attrs, fmt.Sprint(attr.Type, attr.Values))
+	}
+	return attrs
+}
+
+func TestCSRAttrs(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		prof Profile
+		want []string
+	}{
+		{
+			"default",
+			Profile{KeyAlgorithms: DefaultKeyAlgorithms, Curves: DefaultCurves},
+			[]string{
+				"1.2.840.10045.4.3.2",
+				"1.2.840.10045.2.1 [1.2.840.10045.3.1.7]",
+			},
+		},
+		{
+			"curves",
+			Profile{KeyAlgorithms: []string{"ecdsa"}, Curves: []string{"P-384", "P-521"}},
+			[]string{
+				"1.2.840.10045.4.3.3",
+				"1.2.840.10045.4.3.4",
+				"1.2.840.10045.2.1 [1.3.132.0.34 1.3.132.0.35]",
+			},
+		},
+		{
+			"rsa and ed25519",
+			Profile{KeyAlgorithms: []string{"rsa", "ed25519"}, Curves: DefaultCurves},
+			[]string{
+				"1.2.840.113549.1.1.11",
+				"1.2.840.113549.1.1.1",
+				"1.3.101.112",
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			der, err := csrAttrs(&test.prof)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := decodeCSRAttrs(t, der)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("csrAttrs = %q; want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package caserver
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// The size of the nonce returned from an initialisation request, and
+// how long the device has to use it.
+const nonceSize = 32
+const challengeLifetime = 10 * time.Minute
+
+// Maximum size of the attestation blob in an initialisation request.
+const MAX_ATTESTATION_SIZE = 1024 * 4
+
+// errEnrollment indicates that a certification request was not
+// preceded by a matching initialisation request.
+var errEnrollment = errors.New("certification request requires a valid initialisation challenge")
+
+// handleIR processes an initialisation request, recording the device
+// as pending, and returning the nonce that it must echo in its
+// certification request.
+func handleIR(req *protocol.IRRequest) ([]byte, error) {
+	id, err := uuid.Parse(req.ID)
+	if err != nil {
+		return nil, newPolicyError(protocol.PolicyBadDeviceID,
+			"device ID %q is not a UUID", req.ID)
+	}
+	if req.HWSerial == "" {
+		return nil, newPolicyError(protocol.PolicyMissingHWSerial,
+			"missing hardware serial number")
+	}
+	if len(req.Attestation) > MAX_ATTESTATION_SIZE {
+		return nil, newPolicyError(protocol.PolicyAttestationTooLarge,
+			"attestation too large, at most %d bytes permitted", MAX_ATTESTATION_SIZE)
+	}
+	log.Printf("Received IR: %s (hw serial %q)\n", id, req.HWSerial)
+
+	nonce := make([]byte, nonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.AddPendingDevice(id.String(), req.HWSerial, req.Attestation,
+		nonce, time.Now().Add(challengeLifetime))
+	if err != nil {
+		return nil, err
+	}
+
+	return nonce, nil
+}
+
+// checkEnrollment verifies that a certification request for the device
+// `id` is permitted.  A device that made an initialisation request
+// must echo the nonce it was given.  The nonce is only checked here,
+// and is used up when the certificate is recorded.  Devices that did
+// not are only permitted when `server.requireir` is not set, and only
+// if they are new: a device that has enrolled, or has certificates,
+// must renew through `kur` or EST re-enrollment, with its own key, so
+// that a bootstrap certificate can't be used to take it over.
+func checkEnrollment(id string, nonce []byte) error {
+	if nonce != nil {
+		err := db.CheckChallenge(id, nonce)
+		if err == cadb.BadChallenge {
+			return errEnrollment
+		}
+		return err
+	}
+
+	if viper.GetBool("server.requireir") {
+		return errEnrollment
+	}
+
+	_, err := db.DeviceState(id)
+	if err == nil {
+		return errEnrollment
+	}
+	if err != cadb.UnknownDevice {
+		return err
+	}
+
+	devid, err := uuid.Parse(id)
+	if err != nil {
+		return err
+	}
+	serials, err := db.CertsByUUID(devid)
+	if err != nil {
+		return err
+	}
+	if len(serials) > 0 {
+		return errEnrollment
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package caserver
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+)
+
+// errBadReason indicates a revocation request with a reason code we
+// do not support.
+var errBadReason = errors.New("unsupported revocation reason")
+
+// handleKRR processes a key revocation request, marking the
+// certificate as revoked in the database.  A client with a device
+// certificate may revoke the certificates of its own device.  Any
+// other request must be signed with the key of the certificate being
+// revoked.
+func handleKRR(req *protocol.KRRRequest, p *peer) error {
+	// Only permit the reasons that make sense for a full CRL
+	// without support for releasing a hold.
+	switch req.Reason {
+	case protocol.ReasonUnspecified,
+		protocol.ReasonKeyCompromise,
+		protocol.ReasonCACompromise,
+		protocol.ReasonAffiliationChanged,
+		protocol.ReasonSuperseded,
+		protocol.ReasonCessationOfOperation,
+		protocol.ReasonPrivilegeWithdrawn,
+		protocol.ReasonAACompromise:
+	default:
+		return errBadReason
+	}
+
+	if !p.ownsSerial(&req.Serial) {
+		err := checkKRRSignature(req)
+		if err != nil {
+			fmt.Printf("krr: %v\n", err)
+			return errForbidden
+		}
+	}
+
+	log.Printf("Revoking serial %s (reason %d)\n", &req.Serial, req.Reason)
+
+	err := db.RevokeCert(&req.Serial, req.Reason)
+	if err != nil {
+		return err
+	}
+
+	invalidateCRL()
+	return nil
+}
+
+// checkKRRSignature checks that a key revocation request is signed by
+// the key of the certificate it revokes, which proves control of it.
+func checkKRRSignature(req *protocol.KRRRequest) error {
+	if len(req.Sig) == 0 {
+		return fmt.Errorf("serial %s: request is not signed", &req.Serial)
+	}
+
+	_, stored, _, err := db.CertOwner(&req.Serial)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(stored)
+	if err != nil {
+		return err
+	}
+
+	alg, err := kurSignatureAlgorithm(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	return cert.CheckSignature(alg, req.SignedData(), req.Sig)
+}
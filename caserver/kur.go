@@ -0,0 +1,112 @@
+package caserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+)
+
+// errKURAuth indicates that a key update request could not be
+// authenticated against the certificate it asks to replace.
+var errKURAuth = errors.New("key update request not authorized")
+
+// kurSignatureAlgorithm returns the algorithm a device must use to
+// sign the CSR in a key update request, with the key of its current
+// certificate.  ECDSA uses the hash matching the curve size, RSA uses
+// PKCS#1 v1.5 with SHA-256.
+func kurSignatureAlgorithm(pub interface{}) (x509.SignatureAlgorithm, error) {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return x509.ECDSAWithSHA256, nil
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384, nil
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512, nil
+		}
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("Unsupported key type on certificate")
+}
+
+// handleKUR processes a key update request.  The request must carry a
+// currently valid certificate issued by us, along with a signature
+// over the new CSR made with that certificate's key.  The replacement
+// certificate keeps the subject of the current one.  A client with a
+// device certificate may only update the certificates of its own
+// device.
+func handleKUR(req *protocol.KURRequest, p *peer) ([]byte, error) {
+	old, err := x509.ParseCertificate(req.Cert)
+	if err != nil {
+		return nil, newPolicyError(protocol.PolicyBadCertificate,
+			"certificate is invalid: %v", err)
+	}
+	log.Printf("Received KUR for: %v (serial %s)\n", old.Subject, old.SerialNumber)
+
+	// The certificate must be one we issued, and not revoked.
+	stored, err := db.GetCertBySerial(old.SerialNumber)
+	if err != nil {
+		fmt.Printf("kur: %v\n", err)
+		return nil, errKURAuth
+	}
+	if !bytes.Equal(stored, req.Cert) {
+		return nil, errKURAuth
+	}
+	// A bootstrap client proves control of the device below, by
+	// the signature of its key.
+	if p.role == roleDevice && !p.ownsDevice(old.Subject.CommonName) {
+		return nil, errKURAuth
+	}
+
+	now := time.Now()
+	if now.Before(old.NotBefore) || now.After(old.NotAfter) {
+		return nil, errKURAuth
+	}
+
+	// The new CSR must be signed by the key of the current
+	// certificate.
+	alg, err := kurSignatureAlgorithm(old.PublicKey)
+	if err != nil {
+		return nil, newPolicyError(protocol.PolicyKeyAlgorithm, "%v", err)
+	}
+	err = old.CheckSignature(alg, req.CSR, req.Sig)
+	if err != nil {
+		fmt.Printf("kur: %v\n", err)
+		return nil, errKURAuth
+	}
+
+	csr, err := x509.ParseCertificateRequest(req.CSR)
+	if err != nil {
+		return nil, newPolicyError(protocol.PolicyBadCSR, "CSR is invalid: %v", err)
+	}
+	err = checkRequest(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	if csr.Subject.CommonName != old.Subject.CommonName {
+		return nil, newPolicyError(protocol.PolicySubjectMismatch,
+			"CSR subject %q does not match certificate %q",
+			csr.Subject.CommonName, old.Subject.CommonName)
+	}
+
+	prof, err := renewalProfile(old.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	return issueCert(old.Subject, csr.PublicKey, prof, old.SerialNumber, nil)
+}
@@ -0,0 +1,222 @@
+package caserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ocsp"
+)
+
+// The default time between an OCSP response and its nextUpdate, and
+// the default lifetime of a delegated OCSP signing certificate.
+const DefaultOCSPValidity = time.Hour
+const DefaultOCSPSignerValidity = 30 * 24 * time.Hour
+
+// Maximum size of a POSTed OCSP request.
+const MAX_OCSP_REQUEST_SIZE = 1024 * 4
+
+// The delegated OCSP signers, when `ocsp.delegated` is set, by the
+// key identifier of their CA.  They are only held in memory, and
+// replaced when less than half of their lifetime remains.
+var ocspSigners struct {
+	sync.Mutex
+	byCA map[string]*ocspSigner
+}
+
+type ocspSigner struct {
+	sig     *signer.SigningCert
+	refresh time.Time
+}
+
+// getOCSPSigner returns the certificate and key to sign OCSP responses
+// with.  This is either the CA itself, or a delegated signer issued by
+// the CA.  OCSP responses can't be signed with Ed25519, so a CA with
+// an Ed25519 key always delegates, to a signer with an ECDSA key.
+func getOCSPSigner(ca *signer.SigningCert) (*signer.SigningCert, error) {
+	if !viper.GetBool("ocsp.delegated") && ca.Cert.PublicKeyAlgorithm != x509.Ed25519 {
+		return ca, nil
+	}
+
+	ocspSigners.Lock()
+	defer ocspSigners.Unlock()
+
+	key := string(ca.Cert.SubjectKeyId)
+	if cur := ocspSigners.byCA[key]; cur != nil && time.Now().Before(cur.refresh) {
+		return cur.sig, nil
+	}
+
+	validity := viper.GetDuration("ocsp.signervalidity")
+	if validity <= 0 {
+		validity = DefaultOCSPSignerValidity
+	}
+
+	ser, err := db.GetSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := ca.NewOCSPSigningCert(ser, validity)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.AddCert(cadb.OCSPSignerId, "OCSP Signer", "", ser, sig.Cert.SubjectKeyId,
+		sig.Cert.NotAfter, sig.CertBin)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("New OCSP signing certificate: serial %s\n", ser)
+	if ocspSigners.byCA == nil {
+		ocspSigners.byCA = make(map[string]*ocspSigner)
+	}
+	ocspSigners.byCA[key] = &ocspSigner{
+		sig:     sig,
+		refresh: time.Now().Add(validity / 2),
+	}
+	return sig, nil
+}
+
+// issuerMatches checks that the request is for a certificate issued by
+// the given CA certificate.
+func issuerMatches(req *ocsp.Request, ca *x509.Certificate) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	_, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return false
+	}
+
+	h := req.HashAlgorithm.New()
+	h.Write(ca.RawSubject)
+	nameHash := h.Sum(nil)
+
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	keyHash := h.Sum(nil)
+
+	return bytes.Equal(nameHash, req.IssuerNameHash) &&
+		bytes.Equal(keyHash, req.IssuerKeyHash)
+}
+
+// handleOCSP builds a signed OCSP response for a DER encoded request.
+// Errors that are reported as OCSP error responses are returned
+// directly as the response.
+func handleOCSP(raw []byte) []byte {
+	req, err := ocsp.ParseRequest(raw)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+
+	// During a rollover, either CA may have issued the certificate.
+	var ca *signer.SigningCert
+	for _, base := range caBases() {
+		sig, err := signer.LoadSigningCert(base)
+		if err != nil {
+			log.Printf("ocsp: %v\n", err)
+			return ocsp.InternalErrorErrorResponse
+		}
+		if issuerMatches(req, sig.Cert) {
+			ca = sig
+			break
+		}
+	}
+	if ca == nil {
+		return ocsp.UnauthorizedErrorResponse
+	}
+
+	validity := viper.GetDuration("ocsp.nextupdate")
+	if validity <= 0 {
+		validity = DefaultOCSPValidity
+	}
+
+	now := time.Now().UTC()
+	template := ocsp.Response{
+		SerialNumber: req.SerialNumber,
+		IssuerHash:   req.HashAlgorithm,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(validity),
+	}
+
+	revoked, err := db.RevocationStatus(req.SerialNumber)
+	switch {
+	case err == cadb.UnknownSerial:
+		template.Status = ocsp.Unknown
+	case err != nil:
+		log.Printf("ocsp: %v\n", err)
+		return ocsp.InternalErrorErrorResponse
+	case revoked != nil:
+		template.Status = ocsp.Revoked
+		template.RevokedAt = revoked.Revoked
+		template.RevocationReason = revoked.Reason
+	default:
+		template.Status = ocsp.Good
+	}
+
+	sig, err := getOCSPSigner(ca)
+	if err != nil {
+		log.Printf("ocsp: %v\n", err)
+		return ocsp.InternalErrorErrorResponse
+	}
+	if sig != ca {
+		template.Certificate = sig.Cert
+	}
+
+	rsp, err := ocsp.CreateResponse(ca.Cert, sig.Cert, template, sig.PrivateKey)
+	if err != nil {
+		log.Printf("ocsp: %v\n", err)
+		return ocsp.InternalErrorErrorResponse
+	}
+
+	return rsp
+}
+
+// OCSP responder handler, following RFC 6960 appendix A.  A GET
+// request carries the base64 encoded request in the path after
+// `/ocsp/`, a POST request carries it as the body.
+func ocspHandler(w http.ResponseWriter, r *http.Request) {
+	var raw []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		enc := strings.TrimPrefix(r.URL.Path, "/ocsp/")
+		raw, err = base64.StdEncoding.DecodeString(enc)
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/ocsp-request" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		raw, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_OCSP_REQUEST_SIZE))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rsp := ocsp.MalformedRequestErrorResponse
+	if err == nil {
+		rsp = handleOCSP(raw)
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.WriteHeader(http.StatusOK)
+	w.Write(rsp)
+}
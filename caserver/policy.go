@@ -0,0 +1,205 @@
+package caserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// The issuance policy is read from the `[policy]` section of the
+// config file.  These are the defaults for settings that are absent.
+var (
+	DefaultKeyAlgorithms       = []string{"ecdsa"}
+	DefaultCurves              = []string{"P-256"}
+	DefaultRSAKeySizes         = []int{2048, 3072, 4096}
+	DefaultForbiddenExtensions = []string{
+		"2.5.29.19", // basicConstraints
+		"2.5.29.30", // nameConstraints
+	}
+)
+
+const DefaultMaxSANs = 1
+
+// policyError is returned when a CSR is rejected by the issuance
+// policy.  The code is one of the protocol.Policy codes.
+type policyError struct {
+	code int
+	msg  string
+}
+
+func (e *policyError) Error() string {
+	return e.msg
+}
+
+// Response returns the error in its wire form.
+func (e *policyError) Response() *protocol.ErrorResponse {
+	return &protocol.ErrorResponse{
+		Code:  e.code,
+		Error: e.msg,
+	}
+}
+
+func newPolicyError(code int, format string, args ...interface{}) error {
+	return &policyError{
+		code: code,
+		msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// internalError logs an error of the server's own, such as one from
+// the database or the signer, and returns the generic response sent
+// to the client in its place.
+func internalError(err error) *protocol.ErrorResponse {
+	log.Printf("Request failed: %v\n", err)
+	return &protocol.ErrorResponse{
+		Code:  protocol.InternalError,
+		Error: "internal error",
+	}
+}
+
+// policyStrings returns a list setting from the policy, or the default
+// if it is not set.
+func policyStrings(key string, def []string) []string {
+	if viper.IsSet("policy." + key) {
+		return viper.GetStringSlice("policy." + key)
+	}
+	return def
+}
+
+// policyInts returns a list of integers setting from the policy, or
+// the default if it is not set.
+func policyInts(key string, def []int) []int {
+	if viper.IsSet("policy." + key) {
+		return viper.GetIntSlice("policy." + key)
+	}
+	return def
+}
+
+func contains(list []string, item string) bool {
+	for _, s := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSubject checks the subject requested in a new enrollment.  The
+// CN must be a device UUID, in the canonical lower case, hyphenated
+// form that devices are looked up by.  The subject must include every
+// configured `organizations` value, and if `organizationalunits` is
+// configured it must have a single OU from that list.
+func checkSubject(subject pkix.Name) error {
+	id, err := uuid.Parse(subject.CommonName)
+	if err != nil {
+		return newPolicyError(protocol.PolicyBadCommonName,
+			"subject CN %q is not a UUID", subject.CommonName)
+	}
+	if subject.CommonName != id.String() {
+		return newPolicyError(protocol.PolicyBadCommonName,
+			"subject CN %q must be written as %q", subject.CommonName, id.String())
+	}
+
+	for _, org := range viper.GetStringSlice("policy.organizations") {
+		if !contains(subject.Organization, org) {
+			return newPolicyError(protocol.PolicyBadOrganization,
+				"subject must have O=%q", org)
+		}
+	}
+
+	units := viper.GetStringSlice("policy.organizationalunits")
+	if len(units) > 0 {
+		if len(subject.OrganizationalUnit) != 1 ||
+			!contains(units, subject.OrganizationalUnit[0]) {
+			return newPolicyError(protocol.PolicyBadOrgUnit,
+				"subject must have one OU from %q", units)
+		}
+	}
+
+	return nil
+}
+
+// checkRequest checks the signature, extensions and subject
+// alternative names of a CSR.  These apply to renewals as well as new
+// enrollments.  The key is checked against the certificate profile.
+func checkRequest(csr *x509.CertificateRequest) error {
+	if err := csr.CheckSignature(); err != nil {
+		return newPolicyError(protocol.PolicyBadSignature,
+			"CSR signature is invalid: %v", err)
+	}
+
+	forbidden := policyStrings("forbiddenextensions", DefaultForbiddenExtensions)
+	for _, ext := range csr.Extensions {
+		if contains(forbidden, ext.Id.String()) {
+			return newPolicyError(protocol.PolicyForbiddenExtension,
+				"CSR extension %s is not permitted", ext.Id)
+		}
+	}
+
+	max := DefaultMaxSANs
+	if viper.IsSet("policy.maxsans") {
+		max = viper.GetInt("policy.maxsans")
+	}
+	sans := len(csr.DNSNames) + len(csr.EmailAddresses) +
+		len(csr.IPAddresses) + len(csr.URIs)
+	if sans > max {
+		return newPolicyError(protocol.PolicyTooManySANs,
+			"CSR has %d subject alternative names, at most %d permitted", sans, max)
+	}
+
+	return nil
+}
+
+// checkKey checks the public key algorithm against the permitted
+// `algs`, and the curve or key size of ECDSA and RSA keys against
+// `curves` and `rsaSizes`.
+func checkKey(pub interface{}, algs []string, curves []string, rsaSizes []int) error {
+	var alg string
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		alg = "ecdsa"
+	case *rsa.PublicKey:
+		alg = "rsa"
+	case ed25519.PublicKey:
+		alg = "ed25519"
+	default:
+		return newPolicyError(protocol.PolicyKeyAlgorithm,
+			"unsupported public key type %T", pub)
+	}
+
+	if !contains(algs, alg) {
+		return newPolicyError(protocol.PolicyKeyAlgorithm,
+			"key algorithm %s is not permitted", alg)
+	}
+
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		curve := key.Curve.Params().Name
+		if !contains(curves, curve) {
+			return newPolicyError(protocol.PolicyCurve,
+				"curve %s is not permitted", curve)
+		}
+	case *rsa.PublicKey:
+		size := key.N.BitLen()
+		permitted := false
+		for _, s := range rsaSizes {
+			if s == size {
+				permitted = true
+			}
+		}
+		if !permitted {
+			return newPolicyError(protocol.PolicyKeySize,
+				"RSA key size %d is not permitted", size)
+		}
+	}
+
+	return nil
+}
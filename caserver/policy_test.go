@@ -0,0 +1,37 @@
+package caserver
+
+import (
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+	"github.com/spf13/viper"
+)
+
+func TestCheckSubjectCN(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	const id = "3b0f8a4c-7f0e-4c4e-9a53-6f8f1a1b2c3d"
+	err := checkSubject(pkix.Name{CommonName: id})
+	if err != nil {
+		t.Fatalf("checkSubject(%q): %v", id, err)
+	}
+
+	// Devices are looked up by the canonical form, so the others,
+	// which uuid.Parse also accepts, are refused.
+	for _, cn := range []string{
+		"",
+		"device-1",
+		"urn:uuid:" + id,
+		"{" + id + "}",
+		"3b0f8a4c7f0e4c4e9a536f8f1a1b2c3d",
+		"3B0F8A4C-7F0E-4C4E-9A53-6F8F1A1B2C3D",
+	} {
+		err := checkSubject(pkix.Name{CommonName: cn})
+		perr, ok := err.(*policyError)
+		if !ok || perr.code != protocol.PolicyBadCommonName {
+			t.Errorf("checkSubject(%q): %v; want code %d", cn, err, protocol.PolicyBadCommonName)
+		}
+	}
+}
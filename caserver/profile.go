@@ -0,0 +1,277 @@
+package caserver
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/protocol"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// A Profile describes the certificates issued to one class of device.
+// Profiles are defined in `[profiles.<name>]` sections of the config
+// file, and chosen through `[profilemap]`, which maps the OU of the
+// bootstrap certificate used to enroll to a profile name.
+type Profile struct {
+	Name string `mapstructure:"-"`
+
+	// Lifetime of issued certificates.
+	Validity time.Duration `mapstructure:"validity"`
+
+	// Key usages and extended key usages, by their RFC 5280 names,
+	// such as "digitalSignature" and "clientAuth".
+	KeyUsage    []string `mapstructure:"keyusage"`
+	ExtKeyUsage []string `mapstructure:"extkeyusage"`
+
+	// Subject O and OU values to use in place of those in the CSR.
+	Subject struct {
+		Organization       []string `mapstructure:"organization"`
+		OrganizationalUnit []string `mapstructure:"organizationalunit"`
+	} `mapstructure:"subject"`
+
+	// Permitted key types, overriding the policy.
+	KeyAlgorithms []string `mapstructure:"keyalgorithms"`
+	Curves        []string `mapstructure:"curves"`
+	RSAKeySizes   []int    `mapstructure:"rsakeysizes"`
+
+	// Issue CA certificates, with an optional path length limit.
+	CA         bool `mapstructure:"ca"`
+	MaxPathLen *int `mapstructure:"maxpathlen"`
+
+	// Devices may ask for this profile by name, regardless of
+	// their bootstrap certificate.
+	Requestable bool `mapstructure:"requestable"`
+}
+
+// The profile used when no other applies.  A `[profiles.default]`
+// section replaces it.
+const DefaultProfile = "default"
+
+const DefaultProfileValidity = 365 * 24 * time.Hour
+
+// The OU that marks a bootstrap certificate.
+const BootstrapOU = "LinaroCA Bootstrap Cert"
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"keyCertSign":       x509.KeyUsageCertSign,
+	"cRLSign":           x509.KeyUsageCRLSign,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"OCSPSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// getProfile loads the named profile from the config.  Settings that
+// are absent take the defaults of a device certificate.  Returns nil
+// if there is no such profile.
+func getProfile(name string) (*Profile, error) {
+	key := "profiles." + name
+	if !viper.IsSet(key) && name != DefaultProfile {
+		return nil, nil
+	}
+
+	prof := &Profile{}
+	if viper.IsSet(key) {
+		err := viper.UnmarshalKey(key, prof)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %v", name, err)
+		}
+	}
+	prof.Name = name
+
+	if prof.Validity <= 0 {
+		prof.Validity = DefaultProfileValidity
+	}
+	if prof.KeyUsage == nil {
+		prof.KeyUsage = []string{"digitalSignature"}
+	}
+	if prof.ExtKeyUsage == nil {
+		prof.ExtKeyUsage = []string{"clientAuth"}
+	}
+	if prof.KeyAlgorithms == nil {
+		prof.KeyAlgorithms = policyStrings("keyalgorithms", DefaultKeyAlgorithms)
+	}
+	if prof.Curves == nil {
+		prof.Curves = policyStrings("curves", DefaultCurves)
+	}
+	if prof.RSAKeySizes == nil {
+		prof.RSAKeySizes = policyInts("rsakeysizes", DefaultRSAKeySizes)
+	}
+
+	return prof, nil
+}
+
+// mappedProfile returns the profile name `[profilemap]` gives for a
+// bootstrap certificate OU, if any.  Viper folds keys to lower case,
+// so the match ignores case.
+func mappedProfile(ou string) (string, bool) {
+	for k, v := range viper.GetStringMapString("profilemap") {
+		if strings.EqualFold(k, ou) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// bootstrapOU returns the OU of a bootstrap certificate, or "" if
+// there isn't one.
+func bootstrapOU(bootstrap *x509.Certificate) string {
+	if bootstrap == nil || len(bootstrap.Subject.OrganizationalUnit) != 1 {
+		return ""
+	}
+	return bootstrap.Subject.OrganizationalUnit[0]
+}
+
+// selectProfile chooses the profile for a new enrollment.  A device
+// may request a profile by name if it is the one given by the class
+// of its bootstrap certificate, or mapped from it, or is marked as
+// requestable.  Otherwise that profile is used, falling back to the
+// default profile.
+func selectProfile(bootstrap *x509.Certificate, requested string) (*Profile, error) {
+	mapped, ok, err := classProfile(bootstrap)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		mapped = DefaultProfile
+	}
+
+	name := mapped
+	if requested != "" {
+		name = requested
+	}
+
+	prof, err := getProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	if prof == nil {
+		return nil, newPolicyError(protocol.PolicyUnknownProfile,
+			"unknown certificate profile %q", name)
+	}
+	if name != mapped && !prof.Requestable {
+		return nil, newPolicyError(protocol.PolicyProfileNotPermitted,
+			"certificate profile %q is not permitted", name)
+	}
+
+	return prof, nil
+}
+
+// renewalProfile returns the profile a certificate was issued under,
+// so that renewals keep it.
+func renewalProfile(serial *big.Int) (*Profile, error) {
+	name, err := db.CertProfile(serial)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = DefaultProfile
+	}
+
+	prof, err := getProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	if prof == nil {
+		return nil, newPolicyError(protocol.PolicyUnknownProfile,
+			"unknown certificate profile %q", name)
+	}
+	return prof, nil
+}
+
+// isBootstrapOU returns true if `ou` names a bootstrap certificate,
+// either the standard one, or one mapped to a profile.
+func isBootstrapOU(ou string) bool {
+	if ou == BootstrapOU {
+		return true
+	}
+	_, ok := mappedProfile(ou)
+	return ok
+}
+
+// checkKey checks the public key against the key types permitted by
+// the profile.
+func (p *Profile) checkKey(pub interface{}) error {
+	return checkKey(pub, p.KeyAlgorithms, p.Curves, p.RSAKeySizes)
+}
+
+// template builds the certificate template for the given serial
+// number and subject.  The subject O and OU are replaced if the
+// profile sets them.
+func (p *Profile) template(serial *big.Int, subject pkix.Name) (*x509.Certificate, error) {
+	if p.Subject.Organization != nil {
+		subject.Organization = p.Subject.Organization
+	}
+	if p.Subject.OrganizationalUnit != nil {
+		subject.OrganizationalUnit = p.Subject.OrganizationalUnit
+	}
+
+	now := time.Now()
+	cert := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    now,
+		NotAfter:     now.Add(p.Validity),
+
+		BasicConstraintsValid: true,
+		IsCA:                  p.CA,
+	}
+
+	for _, name := range p.KeyUsage {
+		ku, ok := keyUsages[name]
+		if !ok {
+			return nil, fmt.Errorf("profile %q: unknown key usage %q", p.Name, name)
+		}
+		cert.KeyUsage |= ku
+	}
+	for _, name := range p.ExtKeyUsage {
+		eku, ok := extKeyUsages[name]
+		if !ok {
+			return nil, fmt.Errorf("profile %q: unknown extended key usage %q", p.Name, name)
+		}
+		cert.ExtKeyUsage = append(cert.ExtKeyUsage, eku)
+	}
+
+	if p.CA && p.MaxPathLen != nil {
+		cert.MaxPathLen = *p.MaxPathLen
+		cert.MaxPathLenZero = *p.MaxPathLen == 0
+	} else {
+		cert.MaxPathLen = -1
+	}
+
+	// Devices are named by their UUID as a URN, as well as in the
+	// CN.
+	if id, err := uuid.Parse(subject.CommonName); err == nil {
+		urn, err := url.Parse(id.URN())
+		if err != nil {
+			return nil, err
+		}
+		cert.URIs = []*url.URL{urn}
+	}
+
+	// Point relying parties at the public OCSP responder, and at
+	// the CA certificates to build the chain with.  The CRL
+	// depends on the CA, and is added as it is signed.
+	if publicURL != "" {
+		cert.OCSPServer = []string{publicURL + "/ocsp"}
+		cert.IssuingCertificateURL = []string{publicURL + "/api/v1/trust"}
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,39 @@
+package caserver
+
+import (
+	"crypto/x509/pkix"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestTemplateAIA(t *testing.T) {
+	saved := publicURL
+	defer SetPublicURL(saved)
+	prof := &Profile{Name: DefaultProfile}
+	subject := pkix.Name{CommonName: uuid.New().String()}
+
+	SetPublicURL("http://ca.example.com:8080/")
+	cert, err := prof.template(big.NewInt(1), subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http://ca.example.com:8080/ocsp"}; !reflect.DeepEqual(cert.OCSPServer, want) {
+		t.Errorf("OCSPServer = %q; want %q", cert.OCSPServer, want)
+	}
+	if want := []string{"http://ca.example.com:8080/api/v1/trust"}; !reflect.DeepEqual(cert.IssuingCertificateURL, want) {
+		t.Errorf("IssuingCertificateURL = %q; want %q", cert.IssuingCertificateURL, want)
+	}
+
+	// Without a public URL, there is nowhere to point to.
+	SetPublicURL("")
+	cert, err = prof.template(big.NewInt(1), subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.OCSPServer != nil || cert.IssuingCertificateURL != nil {
+		t.Errorf("AIA without a public URL: %q, %q", cert.OCSPServer, cert.IssuingCertificateURL)
+	}
+}
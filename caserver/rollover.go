@@ -0,0 +1,104 @@
+package caserver
+
+import (
+	"bytes"
+	"encoding/pem"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Linaro/lite_bootstrap_server/datadir"
+	"github.com/Linaro/lite_bootstrap_server/signer"
+)
+
+// caBase returns the base name of the CA certificate and key.  During
+// a rollover, its successor and predecessor sit next to it, see the
+// signer package.
+func caBase() string {
+	return datadir.Certs("CA")
+}
+
+// loadIssuer loads the CA that issues certificates now.  This moves to
+// the successor at the scheduled time of a rollover.
+func loadIssuer() (*signer.SigningCert, error) {
+	base, err := signer.IssuerBase(caBase())
+	if err != nil {
+		return nil, err
+	}
+	return signer.LoadSigningCert(base)
+}
+
+// caBases returns the base names of the CA and, during or after a
+// rollover, of its successor or predecessor.  Any of them may have
+// issued a certificate still in use.
+func caBases() []string {
+	current := caBase()
+	bases := []string{current}
+	for _, base := range []string{signer.NextBase(current), signer.PrevBase(current)} {
+		if fileExists(base + ".crt") {
+			bases = append(bases, base)
+		}
+	}
+	return bases
+}
+
+// trustBundle returns the certificates of every CA that is trusted,
+// including both CAs and their cross certificates during a rollover,
+// nearest to the current issuer first.
+func trustBundle() ([][]byte, error) {
+	var bundle [][]byte
+	add := func(der []byte) {
+		for _, b := range bundle {
+			if bytes.Equal(b, der) {
+				return
+			}
+		}
+		bundle = append(bundle, der)
+	}
+
+	for _, der := range issuerChain() {
+		add(der)
+	}
+
+	certs, err := signer.TrustedCerts(caBase())
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range certs {
+		add(cert.Raw)
+	}
+
+	cross, err := signer.CrossCerts(caBase())
+	if err != nil {
+		return nil, err
+	}
+	for _, der := range cross {
+		add(der)
+	}
+
+	return bundle, nil
+}
+
+// Trust bundle handler.  Returns the PEM certificates of all trusted
+// CAs, so that devices can pick up a new CA before a rollover takes
+// effect.
+func trustGet(w http.ResponseWriter, r *http.Request) {
+	bundle, err := trustBundle()
+	if err != nil {
+		log.Printf("trust: %v\n", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "unable to load CA certificates"}`))
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, der := range bundle {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/caserver"
+	"github.com/spf13/cobra"
+)
+
+var bootstrapClass = caserver.BootstrapOU
+var bootstrapCN = "bootstrap-register-1"
+var bootstrapOut = "certs/BOOTSTRAP"
+var bootstrapValidity time.Duration
+var bootstrapProfile string
+var bootstrapMaxEnroll int
+var bootstrapExpires string
+var bootstrapReason int
+
+// bootstrapCertCmd represents the bootstrap-cert command
+var bootstrapCertCmd = &cobra.Command{
+	Use:   "bootstrap-cert",
+	Short: "Bootstrap certificate management",
+	Long: `Management of the device class certificates that devices use to
+authenticate with the server while enrolling.`,
+}
+
+// bootstrapIssueCmd represents the bootstrap-cert issue command
+var bootstrapIssueCmd = &cobra.Command{
+	Use:   "issue",
+	Short: "Issue a bootstrap certificate for a class of devices",
+	Long: `This command issues a device class certificate and key, in place of
+'setup-bootstrap.sh', and records it in the CA database. The certificate and
+key are programmed into every device of the class at the factory. The class
+is given as the subject OU of the certificate, and recorded along with its
+policy: the certificate profile its devices enroll under, how many
+enrollments they may make, and when the class expires. Issuing another
+certificate for a class updates its policy. The following files are written,
+by default, in the data directory:
+
+  certs/BOOTSTRAP.crt, certs/BOOTSTRAP.key   the certificate and key
+  certs/bootstrap_crt.txt                    the certificate as a C string
+  certs/bootstrap_key.txt                    the key as a C array`,
+	Run: func(cmd *cobra.Command, args []string) {
+		crtfile := bootstrapOut + ".crt"
+		keyfile := bootstrapOut + ".key"
+		txtbase := filepath.Join(filepath.Dir(bootstrapOut),
+			strings.ToLower(filepath.Base(bootstrapOut)))
+		if fileExists(crtfile) || fileExists(keyfile) {
+			fmt.Printf("Device class certificates seem to already be present.\n")
+			return
+		}
+		class, err := bootstrapPolicy(bootstrapClass, bootstrapValidity)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			return
+		}
+
+		ca, err := loadIssuer()
+		if err != nil {
+			fmt.Printf("Unable to load CA: %s\n", err)
+			return
+		}
+
+		db, err := cadb.Open()
+		if err != nil {
+			fmt.Printf("Unable to open CA database: %s\n", err)
+			return
+		}
+
+		// The class is recorded first, so that a revoked class
+		// is refused before a certificate is issued.
+		err = db.SetBootstrapClass(class)
+		if err != nil {
+			fmt.Printf("Unable to record class %q: %s\n", class.Name, err)
+			return
+		}
+
+		ser, err := db.GetSerial()
+		if err != nil {
+			fmt.Printf("Unable to get serial number: %s\n", err)
+			return
+		}
+
+		subject := pkix.Name{
+			Organization:       []string{"Linaro, LTD"},
+			OrganizationalUnit: []string{bootstrapClass},
+			CommonName:         bootstrapCN,
+		}
+		boot, err := ca.NewBootstrapCert(ser, subject, bootstrapValidity)
+		if err != nil {
+			fmt.Printf("Unable to create certificate: %s\n", err)
+			return
+		}
+
+		err = db.AddCert(cadb.BootstrapId, bootstrapClass, "", ser, boot.Cert.SubjectKeyId,
+			boot.Cert.NotAfter, boot.CertBin)
+		if err != nil {
+			fmt.Printf("Unable to record certificate: %s\n", err)
+			return
+		}
+
+		err = boot.Export(crtfile, keyfile)
+		if err != nil {
+			fmt.Printf("Unable to write certificate: %s\n", err)
+			return
+		}
+
+		// Copies for inclusion in device applications: the
+		// certificate as a C string, and the key as the bytes
+		// of an SEC1 EC private key.
+		crt, err := ioutil.ReadFile(crtfile)
+		if err == nil {
+			err = ioutil.WriteFile(txtbase+"_crt.txt", cString(crt), 0644)
+		}
+		var key []byte
+		if err == nil {
+			key, err = x509.MarshalECPrivateKey(boot.PrivateKey.(*ecdsa.PrivateKey))
+		}
+		if err == nil {
+			err = ioutil.WriteFile(txtbase+"_key.txt", cArrayBody(key), 0600)
+		}
+		if err != nil {
+			fmt.Printf("Unable to write C copies: %s\n", err)
+			return
+		}
+
+		fmt.Printf("Bootstrap certificate for class %q: serial %s\n", bootstrapClass, ser)
+	},
+}
+
+// bootstrapSetCmd represents the bootstrap-cert set command
+var bootstrapSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Change the policy of a class of devices",
+	Long: `This command changes the policy of an existing class, with the same
+flags as 'bootstrap-cert issue', without issuing a new certificate. Settings
+that aren't given are kept.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := cadb.Open()
+		if err != nil {
+			fmt.Printf("Unable to open CA database: %s\n", err)
+			return
+		}
+
+		cur, err := db.GetBootstrapClass(bootstrapClass)
+		if err == nil && cur == nil {
+			err = cadb.UnknownClass
+		}
+		if err != nil {
+			fmt.Printf("Unable to find class %q: %s\n", bootstrapClass, err)
+			return
+		}
+
+		// Settings that aren't given are kept.
+		class, err := bootstrapPolicy(bootstrapClass, time.Until(cur.Expiry))
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			return
+		}
+		if !cmd.Flags().Changed("profile") {
+			class.Profile = cur.Profile
+		}
+		if !cmd.Flags().Changed("max-enrollments") {
+			class.MaxEnroll = cur.MaxEnroll
+		}
+
+		err = db.SetBootstrapClass(class)
+		if err != nil {
+			fmt.Printf("Unable to set class %q: %s\n", bootstrapClass, err)
+			return
+		}
+	},
+}
+
+// bootstrapListCmd represents the bootstrap-cert list command
+var bootstrapListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the classes of devices and their policies",
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := cadb.Open()
+		if err != nil {
+			fmt.Printf("Unable to open CA database: %s\n", err)
+			return
+		}
+
+		classes, err := db.BootstrapClasses()
+		if err != nil {
+			fmt.Printf("Unable to list classes: %s\n", err)
+			return
+		}
+
+		for _, class := range classes {
+			profile := class.Profile
+			if profile == "" {
+				profile = "(mapped)"
+			}
+			limit := "unlimited"
+			if class.MaxEnroll > 0 {
+				limit = strconv.Itoa(class.MaxEnroll)
+			}
+			state := "active"
+			switch {
+			case class.Revoked:
+				state = "revoked"
+			case time.Now().After(class.Expiry):
+				state = "expired"
+			}
+			fmt.Printf("%q: profile %s, %d of %s enrollments, expires %s, %s\n",
+				class.Name, profile, class.Enrollments, limit,
+				class.Expiry.Format(time.RFC3339), state)
+		}
+	},
+}
+
+// bootstrapRevokeCmd represents the bootstrap-cert revoke command
+var bootstrapRevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke a class of devices",
+	Long: `This command revokes a class, such as one whose bootstrap key has
+leaked, along with all of its bootstrap certificates. Devices of the class
+can no longer connect with them, nor enroll. Other classes are unaffected. A
+revoked class can not be reinstated; issue a certificate for a new class
+instead.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := cadb.Open()
+		if err != nil {
+			fmt.Printf("Unable to open CA database: %s\n", err)
+			return
+		}
+
+		err = db.RevokeBootstrapClass(bootstrapClass, bootstrapReason)
+		if err != nil {
+			fmt.Printf("Unable to revoke class %q: %s\n", bootstrapClass, err)
+			return
+		}
+		fmt.Printf("Revoked class %q\n", bootstrapClass)
+	},
+}
+
+// bootstrapPolicy builds the policy of a class from the flags.  The
+// class expires with its certificate, after `validity`, unless
+// --expires is given.
+func bootstrapPolicy(name string, validity time.Duration) (*cadb.BootstrapClass, error) {
+	if name == "" {
+		return nil, fmt.Errorf("A device class is required")
+	}
+	if bootstrapMaxEnroll < 0 {
+		return nil, fmt.Errorf("--max-enrollments must not be negative")
+	}
+
+	expiry := time.Now().Add(validity)
+	if bootstrapExpires != "" {
+		var err error
+		expiry, err = parseTime(bootstrapExpires)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --expires time: %s", err)
+		}
+	}
+
+	return &cadb.BootstrapClass{
+		Name:      name,
+		Profile:   bootstrapProfile,
+		MaxEnroll: bootstrapMaxEnroll,
+		Expiry:    expiry.UTC(),
+	}, nil
+}
+
+// addBootstrapPolicyFlags adds the flags for the policy of a class.
+func addBootstrapPolicyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&bootstrapProfile, "profile", "", "Certificate profile devices of the class enroll under (default from [profilemap])")
+	cmd.Flags().IntVar(&bootstrapMaxEnroll, "max-enrollments", 0, "Number of enrollments permitted (0 for no limit)")
+	cmd.Flags().StringVar(&bootstrapExpires, "expires", "", "Time after which enrollments are refused, as 2006-01-02 or RFC 3339 (default when the certificate expires)")
+}
+
+func init() {
+	rootCmd.AddCommand(bootstrapCertCmd)
+	bootstrapCertCmd.AddCommand(bootstrapIssueCmd)
+	bootstrapCertCmd.AddCommand(bootstrapSetCmd)
+	bootstrapCertCmd.AddCommand(bootstrapListCmd)
+	bootstrapCertCmd.AddCommand(bootstrapRevokeCmd)
+
+	bootstrapCertCmd.PersistentFlags().StringVar(&bootstrapClass, "class", bootstrapClass, "Device class, given as the subject OU")
+	bootstrapIssueCmd.Flags().StringVar(&bootstrapCN, "cn", bootstrapCN, "Subject CN")
+	bootstrapIssueCmd.Flags().StringVar(&bootstrapOut, "out", bootstrapOut, "Base name of the .crt and .key files to write")
+	dataPathFlag(bootstrapIssueCmd.Flags().Lookup("out"))
+	bootstrapIssueCmd.Flags().DurationVar(&bootstrapValidity, "validity", defaultLeafValidity, "Certificate lifetime")
+	addBootstrapPolicyFlags(bootstrapIssueCmd)
+	addBootstrapPolicyFlags(bootstrapSetCmd)
+	bootstrapRevokeCmd.Flags().IntVar(&bootstrapReason, "reason", 1, "RFC 5280 revocation reason code (default keyCompromise)")
+}
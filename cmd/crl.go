@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/caserver"
+	"github.com/Linaro/lite_bootstrap_server/datadir"
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var crlfile = "certs/CA.crl"
+var crlPem bool
+var crlPrevious bool
+
+// crlCmd represents the crl command
+var crlCmd = &cobra.Command{
+	Use:   "crl",
+	Short: "Certificate revocation list management",
+	Long:  `Generation of certificate revocation lists (CRLs) from the CA database.`,
+}
+
+// crlGenerateCmd represents the crl generate command
+var crlGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a signed CRL",
+	Long: `This command builds a CRL of all of the certificates that have been
+revoked in the CA database, signed by the CA key. Each CRL generated is given
+a new, increasing, CRL number.
+
+During a rollover, the CRL is that of the CA issuing at the time. After one,
+--previous generates the CRL of the old CA instead, for the certificates it
+issued.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := cadb.Open()
+		if err != nil {
+			fmt.Printf("Unable to open CA database: %s\n", err)
+			return
+		}
+
+		err = useCAKey()
+		if err != nil {
+			fmt.Printf("Unable to open CA key: %s\n", err)
+			return
+		}
+
+		// Each CA lists the certificates it issued.
+		base, err := signer.IssuerBase(datadir.Certs("CA"))
+		if err != nil {
+			fmt.Printf("Unable to find CA: %s\n", err)
+			return
+		}
+		if crlPrevious {
+			base = signer.PrevBase(datadir.Certs("CA"))
+		}
+
+		sig, err := signer.LoadSigningCert(base)
+		if err != nil {
+			fmt.Printf("Unable to load CA: %s\n", err)
+			return
+		}
+
+		validity := viper.GetDuration("crl.nextupdate")
+		if validity <= 0 {
+			validity = caserver.DefaultCRLValidity
+		}
+
+		crl, err := caserver.GenerateCRL(db, sig, validity)
+		if err != nil {
+			fmt.Printf("Unable to generate CRL: %s\n", err)
+			return
+		}
+
+		if crlPem {
+			crl = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+		}
+
+		err = ioutil.WriteFile(crlfile, crl, 0644)
+		if err != nil {
+			fmt.Printf("Unable to write CRL: %s\n", err)
+			return
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(crlCmd)
+	crlCmd.AddCommand(crlGenerateCmd)
+
+	// The time until the nextUpdate of the CRL is shared with the
+	// server.
+	crlCmd.PersistentFlags().Duration("next-update", caserver.DefaultCRLValidity, "Time until the CRL's nextUpdate")
+	viper.BindPFlag("crl.nextupdate", crlCmd.PersistentFlags().Lookup("next-update"))
+
+	crlGenerateCmd.Flags().StringVar(&crlfile, "out", crlfile, "Filename for generated CRL")
+	dataPathFlag(crlGenerateCmd.Flags().Lookup("out"))
+	crlGenerateCmd.Flags().BoolVar(&crlPem, "pem", false, "Write the CRL in PEM format instead of DER")
+	crlGenerateCmd.Flags().BoolVar(&crlPrevious, "previous", false, "Generate the CRL of the CA before the last rollover")
+}
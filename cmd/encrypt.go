@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/spf13/cobra"
+)
+
+var encryptBase = "certs/CA"
+
+// encryptCmd encrypts a key that was written unencrypted
+var encryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt an existing CA key",
+	Long: `This command encrypts a CA key that was written without encryption,
+such as by an earlier version, using the passphrase source configured in the
+[cakey] section of the config file. The key file is replaced.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		keyfile := encryptBase + ".key"
+		key, err := signer.LoadKey(keyfile, nil)
+		if err == signer.ErrKeyEncrypted {
+			fmt.Printf("%s is already encrypted\n", keyfile)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Unable to load key: %s\n", err)
+			return
+		}
+
+		passphrase, err := keyPassphrase(encryptBase, true)
+		if err != nil {
+			fmt.Printf("Unable to get passphrase: %s\n", err)
+			return
+		}
+		if passphrase == nil {
+			fmt.Printf("No passphrase source is configured\n")
+			return
+		}
+
+		tmpfile := keyfile + ".new"
+		err = signer.ExportEncryptedKey(tmpfile, key, passphrase)
+		if err != nil {
+			fmt.Printf("Unable to write key: %s\n", err)
+			return
+		}
+
+		err = os.Rename(tmpfile, keyfile)
+		if err != nil {
+			fmt.Printf("Unable to replace key: %s\n", err)
+			return
+		}
+
+		fmt.Printf("Encrypted %s\n", keyfile)
+	},
+}
+
+func init() {
+	cakeyCmd.AddCommand(encryptCmd)
+
+	encryptCmd.Flags().StringVar(&encryptBase, "key", encryptBase, "Key to encrypt, as the base name of the .key file")
+	dataPathFlag(encryptCmd.Flags().Lookup("key"))
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/Linaro/lite_bootstrap_server/signer"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var cafile = "certs/CA.crt"
@@ -26,22 +27,105 @@ keypair can be used on the device side to verify certificate signatures.`,
 			return
 		}
 
-		ca, err := signer.NewSigningCert()
+		err := generateCA(cmd, cafile)
 		if err != nil {
-			fmt.Printf("Unable to create certificate: %s\n", err)
+			fmt.Printf("%s\n", err)
 			return
 		}
+	},
+}
+
+// generateCA creates a new CA certificate, written to `cafile`, with
+// the options from the flags added by addSigningCertFlags.  The key is
+// written alongside, unless it is held in a PKCS#11 token.
+func generateCA(cmd *cobra.Command, cafile string) error {
+	opts, err := signingCertOptions(cmd)
+	if err != nil {
+		return err
+	}
+
+	// A key in a PKCS#11 token is used in place of generating
+	// one, and never written out.
+	key, err := openCAKey()
+	if err != nil {
+		return fmt.Errorf("Unable to open CA key: %s", err)
+	}
+	if key != nil {
+		defer key.Close()
+		opts.Key = key
+	}
+
+	ca, err := signer.NewSigningCert(opts)
+	if err != nil {
+		return fmt.Errorf("Unable to create certificate: %s", err)
+	}
+
+	err = ca.ExportCert(cafile)
+	if err == nil && key == nil {
+		err = exportKey(cafile[:len(cafile)-4], ca.PrivateKey)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write cert: %s", err)
+	}
+
+	return nil
+}
 
-		err = ca.Export(cafile, cafile[:len(cafile)-4]+".key")
+// addSigningCertFlags adds the flags for the options of a new CA.
+func addSigningCertFlags(cmd *cobra.Command) {
+	cmd.Flags().String("key-type", signer.KeyP256, "Key type: P-256, P-384, RSA-3072 or Ed25519")
+	cmd.Flags().Duration("validity", signer.DefaultSigningCertOptions.Validity, "Certificate lifetime")
+	cmd.Flags().String("subject", "", "Subject DN, such as \"/O=Linaro, LTD/CN=Device CA\" (default O=Linaro, LTD and a generated CN)")
+	cmd.Flags().Int("path-len", -1, "Maximum number of intermediate CAs below this one (-1 for no limit)")
+}
+
+// signingCertOptions reads the options of a new CA from the flags
+// added by addSigningCertFlags, falling back to the `[cakey]` section
+// of the config file.
+func signingCertOptions(cmd *cobra.Command) (signer.SigningCertOptions, error) {
+	flags := cmd.Flags()
+	opts := signer.DefaultSigningCertOptions
+
+	opts.KeyType = viper.GetString("cakey.keytype")
+	if flags.Changed("key-type") {
+		opts.KeyType, _ = flags.GetString("key-type")
+	}
+	opts.Validity = viper.GetDuration("cakey.validity")
+	if flags.Changed("validity") {
+		opts.Validity, _ = flags.GetDuration("validity")
+	}
+	opts.MaxPathLen = viper.GetInt("cakey.pathlen")
+	if flags.Changed("path-len") {
+		opts.MaxPathLen, _ = flags.GetInt("path-len")
+	}
+	subject := viper.GetString("cakey.subject")
+	if flags.Changed("subject") {
+		subject, _ = flags.GetString("subject")
+	}
+
+	if subject != "" {
+		name, err := signer.ParseSubject(subject)
 		if err != nil {
-			fmt.Printf("Unable to write cert: %s\n", err)
-			return
+			return opts, fmt.Errorf("Invalid subject: %s", err)
 		}
-	},
+		opts.Subject = name
+	}
+	if opts.Validity <= 0 {
+		return opts, fmt.Errorf("Validity must be positive")
+	}
+
+	return opts, nil
 }
 
 func init() {
 	cakeyCmd.AddCommand(generateCmd)
 
 	generateCmd.Flags().StringVar(&cafile, "cafile", cafile, "Filename for generated certificate")
+	dataPathFlag(generateCmd.Flags().Lookup("cafile"))
+	addSigningCertFlags(generateCmd)
+
+	viper.BindPFlag("cakey.keytype", generateCmd.Flags().Lookup("key-type"))
+	viper.BindPFlag("cakey.validity", generateCmd.Flags().Lookup("validity"))
+	viper.BindPFlag("cakey.subject", generateCmd.Flags().Lookup("subject"))
+	viper.BindPFlag("cakey.pathlen", generateCmd.Flags().Lookup("path-len"))
 }
@@ -1,31 +1,177 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 
+	"github.com/Linaro/lite_bootstrap_server/signer"
 	"github.com/spf13/cobra"
 )
 
+var getpubBase = "certs/CA"
+var getpubFormat = "pem"
+var getpubSPKI bool
+var getpubName string
+var getpubOut string
+
 // getpubCmd represents the getpub command
 var getpubCmd = &cobra.Command{
 	Use:   "getpub",
 	Short: "Get public CA key",
-	Long:  `Returns the public CA key in DER and PEM format.`,
+	Long: `Returns the CA certificate, or with --spki just its public key as a
+SubjectPublicKeyInfo, so that it can be built into device firmware as the
+trust anchor. The --format flag selects one of:
+
+  pem      PEM text
+  der      raw DER
+  c        a C array, in the form written by 'xxd -i'
+  dts      a Zephyr devicetree byte array property
+  kconfig  a Zephyr Kconfig setting holding the PEM text
+  rust     a Rust const byte slice
+
+The --name flag sets the identifier used in the c, dts, kconfig and rust
+forms.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("getpub called")
+		cert, err := signer.LoadCert(getpubBase + ".crt")
+		if err != nil {
+			fmt.Printf("Unable to load CA certificate: %s\n", err)
+			return
+		}
+
+		der, kind, name := cert.Raw, "CERTIFICATE", "ca_crt"
+		if getpubSPKI {
+			der, kind, name = cert.RawSubjectPublicKeyInfo, "PUBLIC KEY", "ca_pub"
+		}
+		if getpubName != "" {
+			name = getpubName
+		}
+
+		var out []byte
+		switch getpubFormat {
+		case "pem":
+			out = pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+		case "der":
+			out = der
+		case "c":
+			out = cArray(name, der)
+		case "dts":
+			out = dtsProperty(name, der)
+		case "kconfig":
+			out = kconfigString(name, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}))
+		case "rust":
+			out = rustConst(name, der)
+		default:
+			fmt.Printf("Unknown format %q\n", getpubFormat)
+			return
+		}
+
+		if getpubOut == "" {
+			os.Stdout.Write(out)
+			return
+		}
+		err = ioutil.WriteFile(getpubOut, out, 0644)
+		if err != nil {
+			fmt.Printf("Unable to write %s: %s\n", getpubOut, err)
+		}
 	},
 }
 
-func init() {
-	cakeyCmd.AddCommand(getpubCmd)
+// hexLines formats data as hex bytes, `perLine` to a line.  Each
+// line is passed the bytes already formatted, and whether it is the
+// last line.
+func hexLines(data []byte, perLine int, byteFmt string, line func(hex []string, last bool)) {
+	for i := 0; i < len(data); i += perLine {
+		end := i + perLine
+		if end > len(data) {
+			end = len(data)
+		}
+		var hex []string
+		for _, b := range data[i:end] {
+			hex = append(hex, fmt.Sprintf(byteFmt, b))
+		}
+		line(hex, end == len(data))
+	}
+}
+
+// cArray formats data as a C array, in the same form as `xxd -i`.
+func cArray(name string, data []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "unsigned char %s[] = {\n", name)
+	buf.Write(cArrayBody(data))
+	fmt.Fprintf(&buf, "};\nunsigned int %s_len = %d;\n", name, len(data))
+	return buf.Bytes()
+}
 
-	// Here you will define your flags and configuration settings.
+// cArrayBody formats just the bytes of a C array, in the same form
+// as `xxd -i` reading standard input.
+func cArrayBody(data []byte) []byte {
+	var buf bytes.Buffer
+	hexLines(data, 12, "0x%02x", func(hex []string, last bool) {
+		sep := ","
+		if last {
+			sep = ""
+		}
+		fmt.Fprintf(&buf, "  %s%s\n", strings.Join(hex, ", "), sep)
+	})
+	return buf.Bytes()
+}
+
+// cString formats text as a series of C string literals, one per
+// line, with CRLF line endings.
+func cString(text []byte) []byte {
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(string(text), "\n") {
+		line = strings.TrimSuffix(line, "\n")
+		if line != "" {
+			fmt.Fprintf(&buf, "\"%s\\r\\n\"\n", line)
+		}
+	}
+	return buf.Bytes()
+}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// getpubCmd.PersistentFlags().String("foo", "", "A help for foo")
+// dtsProperty formats data as a devicetree byte array property, to be
+// included in a node.  Devicetree names use '-' in place of '_'.
+func dtsProperty(name string, data []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s = [", strings.Replace(name, "_", "-", -1))
+	hexLines(data, 16, "%02x", func(hex []string, last bool) {
+		fmt.Fprintf(&buf, "\n\t%s", strings.Join(hex, " "))
+	})
+	buf.WriteString("];\n")
+	return buf.Bytes()
+}
+
+// kconfigString formats text as a Kconfig string setting, for a
+// prj.conf or overlay .conf file.
+func kconfigString(name string, text []byte) []byte {
+	s := strings.Replace(string(text), `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return []byte(fmt.Sprintf("CONFIG_%s=\"%s\"\n", strings.ToUpper(name), s))
+}
+
+// rustConst formats data as a Rust const byte slice.
+func rustConst(name string, data []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "pub const %s: &[u8] = &[\n", strings.ToUpper(name))
+	hexLines(data, 12, "0x%02x", func(hex []string, last bool) {
+		fmt.Fprintf(&buf, "    %s,\n", strings.Join(hex, ", "))
+	})
+	buf.WriteString("];\n")
+	return buf.Bytes()
+}
+
+func init() {
+	cakeyCmd.AddCommand(getpubCmd)
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// getpubCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	getpubCmd.Flags().StringVar(&getpubBase, "ca", getpubBase, "CA, as the base name of the .crt file")
+	dataPathFlag(getpubCmd.Flags().Lookup("ca"))
+	getpubCmd.Flags().StringVarP(&getpubFormat, "format", "f", getpubFormat, "Output format: pem, der, c, dts, kconfig or rust")
+	getpubCmd.Flags().BoolVar(&getpubSPKI, "spki", false, "Output only the public key, as a SubjectPublicKeyInfo")
+	getpubCmd.Flags().StringVar(&getpubName, "name", "", "Identifier for the c, dts, kconfig and rust formats (default ca_crt, or ca_pub with --spki)")
+	getpubCmd.Flags().StringVarP(&getpubOut, "out", "o", "", "File to write, in place of standard output")
 }
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/cadb"
+	"github.com/Linaro/lite_bootstrap_server/datadir"
+	"github.com/spf13/cobra"
+)
+
+var initHostname string
+var initValidity time.Duration
+
+// The lifetime of the server and bootstrap certificates, as written by
+// earlier setup scripts.
+const defaultLeafValidity = 3560 * 24 * time.Hour
+
+// initCmd represents the init command
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Set up the CA and server certificates",
+	Long: `This command sets up a new CA, in place of 'setup-ca.sh'. It creates
+the CA with the same flags and settings as 'cakey generate', unless
+certs/CA.crt already exists, such as an issuing CA created with 'cakey csr'
+and 'cakey sign'. It then issues the server's TLS certificate for the
+hostname, and records it in the CA database. The following files are
+written, in the data directory:
+
+  certs/CA.crt, certs/CA.key   the CA, if it didn't exist
+  certs/ca_crt.txt             the CA certificate as a C string
+  certs/SERVER.crt/.key        the server certificate and key
+  CADB.db                      the CA database, unless database.dsn
+                               names another
+
+The hostname is taken from --hostname, or else as for 'server start'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		serverCrt, serverKey := datadir.Certs("SERVER.crt"), datadir.Certs("SERVER.key")
+		if fileExists(serverCrt) || fileExists(serverKey) {
+			fmt.Printf("Server certificates seem to already be present.\n")
+			return
+		}
+		if name := cadb.LocalFile(); name != "" && fileExists(name) {
+			fmt.Printf("Server/CA database (%s) seems to already be present.\n", name)
+			return
+		}
+
+		hostname := initHostname
+		if hostname == "" {
+			hostname = getHostname()
+		}
+
+		err := os.MkdirAll(datadir.Path("certs"), 0755)
+		if err != nil {
+			fmt.Printf("Unable to create certs directory: %s\n", err)
+			return
+		}
+
+		cafile := datadir.Certs("CA.crt")
+		if !fileExists(cafile) {
+			err = generateCA(cmd, cafile)
+			if err != nil {
+				fmt.Printf("%s\n", err)
+				return
+			}
+		}
+
+		ca, err := loadIssuer()
+		if err != nil {
+			fmt.Printf("Unable to load CA: %s\n", err)
+			return
+		}
+
+		// The CA certificate as a C string, for inclusion in
+		// device applications.
+		txtfile := datadir.Certs("ca_crt.txt")
+		cert, err := ioutil.ReadFile(cafile)
+		if err == nil {
+			err = ioutil.WriteFile(txtfile, cString(cert), 0644)
+		}
+		if err != nil {
+			fmt.Printf("Unable to write %s: %s\n", txtfile, err)
+			return
+		}
+
+		db, err := cadb.Open()
+		if err != nil {
+			fmt.Printf("Unable to open CA database: %s\n", err)
+			return
+		}
+
+		ser, err := db.GetSerial()
+		if err != nil {
+			fmt.Printf("Unable to get serial number: %s\n", err)
+			return
+		}
+
+		server, err := ca.NewServerCert(ser, hostname, initValidity)
+		if err != nil {
+			fmt.Printf("Unable to create server certificate: %s\n", err)
+			return
+		}
+
+		err = db.AddCert(cadb.ServerId, hostname, "", ser, server.Cert.SubjectKeyId,
+			server.Cert.NotAfter, server.CertBin)
+		if err != nil {
+			fmt.Printf("Unable to record server certificate: %s\n", err)
+			return
+		}
+
+		err = server.Export(serverCrt, serverKey)
+		if err != nil {
+			fmt.Printf("Unable to write server certificate: %s\n", err)
+			return
+		}
+
+		fmt.Printf("Server certificate for %s: serial %s\n", hostname, ser)
+	},
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+
+	initCmd.Flags().StringVar(&initHostname, "hostname", "", "Hostname for the server certificate")
+	initCmd.Flags().DurationVar(&initValidity, "server-validity", defaultLeafValidity, "Server certificate lifetime")
+	addSigningCertFlags(initCmd)
+}
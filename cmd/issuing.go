@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"crypto"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/spf13/cobra"
+)
+
+var csrKeyFile = "certs/CA.key"
+var csrFile = "certs/CA.csr"
+var csrKeyType = signer.KeyP256
+var csrSubject = "/O=Linaro, LTD/CN=Linaro Issuing CA"
+
+// csrCmd generates the key and CSR for an issuing CA
+var csrCmd = &cobra.Command{
+	Use:   "csr",
+	Short: "Generate an issuing CA key and CSR",
+	Long: `This command generates a new key for an issuing (intermediate) CA,
+along with a certificate signing request to be signed by the offline root
+with 'cakey sign'. The key stays with the server, which uses the issuing CA
+to sign device certificates.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		subject, err := signer.ParseSubject(csrSubject)
+		if err != nil {
+			fmt.Printf("Invalid subject: %s\n", err)
+			return
+		}
+
+		// A key in a PKCS#11 token is used in place of generating
+		// one, and never written out.
+		var key crypto.Signer
+		hsmKey, err := openCAKey()
+		if err != nil {
+			fmt.Printf("Unable to open CA key: %s\n", err)
+			return
+		}
+		if hsmKey != nil {
+			defer hsmKey.Close()
+			key = hsmKey
+		} else {
+			key, err = signer.GenerateKey(csrKeyType)
+			if err != nil {
+				fmt.Printf("Unable to generate key: %s\n", err)
+				return
+			}
+
+			err = exportKey(strings.TrimSuffix(csrKeyFile, ".key"), key)
+			if err != nil {
+				fmt.Printf("Unable to write key: %s\n", err)
+				return
+			}
+		}
+
+		csr, err := signer.NewCACSR(key, subject)
+		if err != nil {
+			fmt.Printf("Unable to create CSR: %s\n", err)
+			return
+		}
+
+		err = signer.ExportCSR(csrFile, csr)
+		if err != nil {
+			fmt.Printf("Unable to write CSR: %s\n", err)
+			return
+		}
+
+		fmt.Printf("Wrote %s\n", csrFile)
+	},
+}
+
+var signRoot = "certs/ROOT"
+var signCSR = "certs/CA.csr"
+var signOut = "certs/CA.crt"
+var signValidity = 5 * 365 * 24 * time.Hour
+var signPathLen = 0
+
+// signCmd signs an issuing CA CSR with the root
+var signCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "Sign an issuing CA CSR with the root CA",
+	Long: `This command signs the CSR of an issuing (intermediate) CA with the
+root CA key, which may be kept offline. The issuing CA certificate is
+written along with a -chain.crt file holding the certificates above it, so
+the server can return the full chain to devices.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if path.Ext(signOut) != ".crt" {
+			fmt.Printf("Expect certificate to end in '.crt'\n")
+			return
+		}
+
+		err := unlockKey(signRoot)
+		if err != nil {
+			fmt.Printf("Unable to unlock root key: %s\n", err)
+			return
+		}
+
+		root, err := signer.LoadSigningCert(signRoot)
+		if err != nil {
+			fmt.Printf("Unable to load root CA: %s\n", err)
+			return
+		}
+
+		csr, err := signer.LoadCSR(signCSR)
+		if err != nil {
+			fmt.Printf("Unable to load CSR: %s\n", err)
+			return
+		}
+
+		ca, err := root.SignCA(csr, signValidity, signPathLen)
+		if err != nil {
+			fmt.Printf("Unable to sign CSR: %s\n", err)
+			return
+		}
+
+		err = ca.ExportCert(signOut)
+		if err != nil {
+			fmt.Printf("Unable to write cert: %s\n", err)
+			return
+		}
+
+		fmt.Printf("Issued %v, serial %s\n", ca.Cert.Subject, ca.Cert.SerialNumber)
+	},
+}
+
+func init() {
+	cakeyCmd.AddCommand(csrCmd)
+	cakeyCmd.AddCommand(signCmd)
+
+	csrCmd.Flags().StringVar(&csrKeyFile, "key", csrKeyFile, "Filename for the generated key")
+	csrCmd.Flags().StringVar(&csrFile, "csr", csrFile, "Filename for the generated CSR")
+	csrCmd.Flags().StringVar(&csrKeyType, "key-type", csrKeyType, "Key type: P-256, P-384, RSA-3072 or Ed25519")
+	csrCmd.Flags().StringVar(&csrSubject, "subject", csrSubject, "Subject DN of the issuing CA")
+
+	signCmd.Flags().StringVar(&signRoot, "root", signRoot, "Root CA, as the base name of the .crt and .key files")
+	signCmd.Flags().StringVar(&signCSR, "csr", signCSR, "CSR to sign")
+	signCmd.Flags().StringVar(&signOut, "cafile", signOut, "Filename for the issued certificate")
+	signCmd.Flags().DurationVar(&signValidity, "validity", signValidity, "Certificate lifetime, limited to that of the root")
+	signCmd.Flags().IntVar(&signPathLen, "path-len", signPathLen, "Maximum number of CAs below the issuing CA (-1 for no limit)")
+
+	dataPathFlag(csrCmd.Flags().Lookup("key"))
+	dataPathFlag(csrCmd.Flags().Lookup("csr"))
+	dataPathFlag(signCmd.Flags().Lookup("root"))
+	dataPathFlag(signCmd.Flags().Lookup("csr"))
+	dataPathFlag(signCmd.Flags().Lookup("cafile"))
+}
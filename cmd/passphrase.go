@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Linaro/lite_bootstrap_server/datadir"
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/spf13/viper"
+)
+
+// keyPassphrase returns the passphrase protecting the key base.key,
+// read from the file named by `cakey.passphrasefile`, the environment
+// variable named by `cakey.passphraseenv`, or unwrapped from base.pass
+// by the `cakey.unwrap` provider, in that order.  With `create`, the
+// unwrap provider generates a new passphrase instead.  Returns nil if
+// keys are not encrypted.
+func keyPassphrase(base string, create bool) ([]byte, error) {
+	if name := viper.GetString("cakey.passphrasefile"); name != "" {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("Passphrase file: %v", err)
+		}
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+
+	if name := viper.GetString("cakey.passphraseenv"); name != "" {
+		pass, ok := os.LookupEnv(name)
+		if !ok || pass == "" {
+			return nil, fmt.Errorf("Passphrase environment variable %s is not set", name)
+		}
+		return []byte(pass), nil
+	}
+
+	if uri := viper.GetString("cakey.unwrap"); uri != "" {
+		w, err := signer.OpenKeyWrapper(uri)
+		if err != nil {
+			return nil, err
+		}
+		if create {
+			return signer.NewWrappedPassphrase(w, base)
+		}
+		return signer.UnwrapPassphrase(w, base)
+	}
+
+	return nil, nil
+}
+
+// exportKey writes a newly generated key to base.key, encrypted if a
+// passphrase source is configured.
+func exportKey(base string, key crypto.Signer) error {
+	passphrase, err := keyPassphrase(base, true)
+	if err != nil {
+		return err
+	}
+	if passphrase == nil {
+		return signer.ExportKey(base+".key", key)
+	}
+	return signer.ExportEncryptedKey(base+".key", key, passphrase)
+}
+
+// unlockKey decrypts base.key if it is encrypted, and holds it in
+// memory for the signer to use.
+func unlockKey(base string) error {
+	passphrase, err := keyPassphrase(base, false)
+	if err != nil {
+		return err
+	}
+	return signer.UnlockKey(base, passphrase)
+}
+
+// useCAKey prepares the CA key for signing.  It is opened in a
+// PKCS#11 token if one is configured, and otherwise read, and
+// decrypted if need be, once.  The keys of the CAs of a rollover are
+// also read.
+func useCAKey() error {
+	key, err := openCAKey()
+	if err != nil {
+		return err
+	}
+	ca := datadir.Certs("CA")
+	if key != nil {
+		signer.UseKey(ca, key)
+	} else {
+		err = unlockKey(ca)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, base := range []string{signer.NextBase(ca), signer.PrevBase(ca)} {
+		if _, err := os.Stat(base + ".key"); err != nil {
+			continue
+		}
+		err = unlockKey(base)
+		if err != nil {
+			return fmt.Errorf("%s: %v", base, err)
+		}
+	}
+	return nil
+}
+
+// loadIssuer prepares the CA key, and loads the CA that issues
+// certificates now, which moves to the successor at the scheduled
+// time of a rollover.
+func loadIssuer() (*signer.SigningCert, error) {
+	err := useCAKey()
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := signer.IssuerBase(datadir.Certs("CA"))
+	if err != nil {
+		return nil, err
+	}
+	return signer.LoadSigningCert(base)
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/spf13/viper"
+)
+
+// openCAKey opens the CA key in a PKCS#11 token, when the `[pkcs11]`
+// section of the config file names a module.  Returns nil if the CA
+// key is kept in a file.
+func openCAKey() (*signer.PKCS11Key, error) {
+	if !viper.IsSet("pkcs11.module") {
+		return nil, nil
+	}
+
+	pin, err := pkcs11PIN()
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.OpenPKCS11Key(signer.PKCS11Config{
+		Module:     viper.GetString("pkcs11.module"),
+		TokenLabel: viper.GetString("pkcs11.token"),
+		Slot:       viper.GetUint("pkcs11.slot"),
+		PIN:        pin,
+		KeyLabel:   viper.GetString("pkcs11.label"),
+	})
+}
+
+// pkcs11PIN reads the token PIN from the file named by `pinfile`, the
+// environment variable named by `pinenv`, or `pin` itself, in that
+// order.
+func pkcs11PIN() (string, error) {
+	if name := viper.GetString("pkcs11.pinfile"); name != "" {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("PIN file: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	if name := viper.GetString("pkcs11.pinenv"); name != "" {
+		pin, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("PIN environment variable %s is not set", name)
+		}
+		return pin, nil
+	}
+
+	return viper.GetString("pkcs11.pin"), nil
+}
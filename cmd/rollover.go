@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Linaro/lite_bootstrap_server/signer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var rolloverBase = "certs/CA"
+var rolloverAt string
+
+// rolloverCmd represents the rollover command
+var rolloverCmd = &cobra.Command{
+	Use:   "rollover",
+	Short: "Roll the CA over to a new key",
+	Long: `These commands replace the CA with a new one before it expires. The new
+CA is cross-signed with the old one, so that devices trusting either can
+verify certificates from both, and takes over issuance at a scheduled time.
+Clients with certificates from either CA are accepted until the rollover is
+completed and the old CA expires.`,
+}
+
+// rolloverStartCmd represents the rollover start command
+var rolloverStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Generate the new CA and schedule the switch to it",
+	Long: `This command generates the new CA, with the same flags and settings
+as 'cakey generate', along with a cross certificate for each CA signed by
+the other. The new CA takes over issuance at the time given by --at. The
+server must be restarted to trust the new CA.
+
+Only a root CA can be rolled over. An issuing CA, with a -chain.crt file, is
+refused; sign a new issuing CA with the root instead, using 'cakey csr' and
+'cakey sign'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		at, err := parseTime(rolloverAt)
+		if err != nil {
+			fmt.Printf("Invalid --at time: %s\n", err)
+			return
+		}
+
+		if viper.IsSet("pkcs11.module") {
+			fmt.Printf("Rollover of a CA key in a PKCS#11 token is not supported\n")
+			return
+		}
+
+		// Check before the new key is generated and written, so
+		// that a refused rollover leaves nothing behind.
+		err = signer.CheckRollover(rolloverBase)
+		if err != nil {
+			fmt.Printf("Unable to start rollover: %s\n", err)
+			return
+		}
+
+		err = unlockKey(rolloverBase)
+		if err != nil {
+			fmt.Printf("Unable to unlock CA key: %s\n", err)
+			return
+		}
+
+		opts, err := signingCertOptions(cmd)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			return
+		}
+
+		next, err := signer.NewSigningCert(opts)
+		if err != nil {
+			fmt.Printf("Unable to create certificate: %s\n", err)
+			return
+		}
+
+		err = exportKey(signer.NextBase(rolloverBase), next.PrivateKey)
+		if err != nil {
+			fmt.Printf("Unable to write key: %s\n", err)
+			return
+		}
+
+		err = signer.StartRollover(rolloverBase, next, at)
+		if err != nil {
+			fmt.Printf("Unable to start rollover: %s\n", err)
+			return
+		}
+
+		fmt.Printf("New CA %v takes over issuance at %s\n",
+			next.Cert.Subject, at.Format(time.RFC3339))
+	},
+}
+
+// rolloverStatusCmd represents the rollover status command
+var rolloverStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the progress of a rollover",
+	Run: func(cmd *cobra.Command, args []string) {
+		at, ok, err := signer.RolloverTime(rolloverBase)
+		if err != nil {
+			fmt.Printf("Unable to read rollover: %s\n", err)
+			return
+		}
+		if ok {
+			fmt.Printf("Switch to %s at %s\n", signer.NextBase(rolloverBase),
+				at.Format(time.RFC3339))
+		} else {
+			fmt.Printf("No rollover in progress\n")
+		}
+
+		issuer, err := signer.IssuerBase(rolloverBase)
+		if err != nil {
+			fmt.Printf("Unable to read rollover: %s\n", err)
+			return
+		}
+		fmt.Printf("Issuing CA: %s\n", issuer)
+
+		certs, err := signer.TrustedCerts(rolloverBase)
+		if err != nil {
+			fmt.Printf("Unable to load CAs: %s\n", err)
+			return
+		}
+		for _, cert := range certs {
+			fmt.Printf("Trusted: %v, until %s\n", cert.Subject,
+				cert.NotAfter.Format(time.RFC3339))
+		}
+	},
+}
+
+// rolloverCompleteCmd represents the rollover complete command
+var rolloverCompleteCmd = &cobra.Command{
+	Use:   "complete",
+	Short: "Make the new CA the current one",
+	Long: `Once the switch time has passed, this command renames the new CA
+files to take the place of the old CA, which is kept as the previous CA and
+trusted until it expires. The server must be restarted afterwards.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := signer.CompleteRollover(rolloverBase)
+		if err != nil {
+			fmt.Printf("Unable to complete rollover: %s\n", err)
+			return
+		}
+		fmt.Printf("Rollover of %s complete\n", rolloverBase)
+	},
+}
+
+// parseTime parses a time in RFC 3339 form, or a UTC date.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, fmt.Errorf("a time is required")
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func init() {
+	cakeyCmd.AddCommand(rolloverCmd)
+	rolloverCmd.AddCommand(rolloverStartCmd)
+	rolloverCmd.AddCommand(rolloverStatusCmd)
+	rolloverCmd.AddCommand(rolloverCompleteCmd)
+
+	rolloverCmd.PersistentFlags().StringVar(&rolloverBase, "ca", rolloverBase, "CA, as the base name of the .crt and .key files")
+	dataPathFlag(rolloverCmd.PersistentFlags().Lookup("ca"))
+	addSigningCertFlags(rolloverStartCmd)
+	rolloverStartCmd.Flags().StringVar(&rolloverAt, "at", "", "Time the new CA takes over issuance, as 2006-01-02 or RFC 3339")
+}
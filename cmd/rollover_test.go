@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Linaro/lite_bootstrap_server/signer"
+)
+
+func TestRolloverStartIssuingCA(t *testing.T) {
+	// An issuing CA is only told apart by its chain file, so a
+	// root CA with one will do.
+	dir := t.TempDir()
+	base := filepath.Join(dir, "CA")
+	ca, err := signer.NewSigningCert(signer.DefaultSigningCertOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ca.Export(base+".crt", base+".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(base+"-chain.crt", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, savedAt := rolloverBase, rolloverAt
+	rolloverBase, rolloverAt = base, "2030-01-01"
+	defer func() { rolloverBase, rolloverAt = saved, savedAt }()
+
+	rolloverStartCmd.Run(rolloverStartCmd, nil)
+
+	// The new CA's key isn't generated, nor anything else written.
+	files, err := filepath.Glob(signer.NextBase(base) + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("refused rollover wrote %q", files)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"log"
 	"os"
 
+	"github.com/Linaro/lite_bootstrap_server/datadir"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
@@ -13,6 +15,10 @@ import (
 
 var cfgFile string
 
+// pathFlags are the flags naming files that default to a path in the
+// data directory, see dataPathFlag.
+var pathFlags []*pflag.Flag
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "liteboot",
@@ -39,6 +45,9 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.liteboot.yaml)")
+	rootCmd.PersistentFlags().String("data-dir", "", "Directory holding the CA database and certs (default is the working directory)")
+	viper.BindPFlag("datadir", rootCmd.PersistentFlags().Lookup("data-dir"))
+	viper.BindEnv("datadir", "LITEBOOT_DATADIR")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -58,7 +67,12 @@ func initConfig() {
 			os.Exit(1)
 		}
 
-		// Search config in home directory with name ".liteboot" (without extension).
+		// Search config in the data directory, the working
+		// directory, and then the home directory with name
+		// ".liteboot" (without extension).
+		if dir := viper.GetString("datadir"); dir != "" {
+			viper.AddConfigPath(dir)
+		}
 		viper.AddConfigPath(".")
 		viper.AddConfigPath(home)
 		viper.SetConfigName(".liteboot")
@@ -70,4 +84,17 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
+
+	for _, f := range pathFlags {
+		if !f.Changed {
+			f.Value.Set(datadir.Path(f.DefValue))
+		}
+	}
+}
+
+// dataPathFlag marks a flag as naming a file, whose default is relative
+// to the data directory.  A path given on the command line is relative
+// to the working directory as usual.
+func dataPathFlag(f *pflag.Flag) {
+	pathFlags = append(pathFlags, f)
 }
@@ -21,6 +21,13 @@ func init() {
 	// Allow a custom port number
 	serverCmd.PersistentFlags().Int16P("port", "p", 1443, "CA port number")
 	serverCmd.PersistentFlags().Int16P("mport", "m", 8443, "mTLS port number")
+	serverCmd.PersistentFlags().Int16("cport", 5684, "CoAP over DTLS port number (0 to disable)")
+	serverCmd.PersistentFlags().Int16("pubport", 8080, "Public HTTP port number for the CRL and OCSP (0 to disable)")
+
+	// Require devices to make an initialisation request before a
+	// certification request.
+	serverCmd.PersistentFlags().String("publicurl", "", "Base URL of the public server in issued certificates (default http://hostname:pubport)")
+	serverCmd.PersistentFlags().Bool("require-ir", false, "Require an initialisation request before a certification request")
 
 	// Configure the cloud service.
 	serverCmd.PersistentFlags().String("hubname", "hubname", "Azure Hub Name")
@@ -32,5 +39,9 @@ func init() {
 	viper.BindPFlag("server.resourcegroup", serverCmd.PersistentFlags().Lookup("resourcegroup"))
 	viper.BindPFlag("server.port", serverCmd.PersistentFlags().Lookup("port"))
 	viper.BindPFlag("server.mport", serverCmd.PersistentFlags().Lookup("mport"))
+	viper.BindPFlag("server.cport", serverCmd.PersistentFlags().Lookup("cport"))
+	viper.BindPFlag("server.pubport", serverCmd.PersistentFlags().Lookup("pubport"))
 	viper.BindPFlag("server.mqttport", serverCmd.PersistentFlags().Lookup("mqttport"))
+	viper.BindPFlag("server.publicurl", serverCmd.PersistentFlags().Lookup("publicurl"))
+	viper.BindPFlag("server.requireir", serverCmd.PersistentFlags().Lookup("require-ir"))
 }
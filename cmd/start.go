@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"log"
 	"os"
+	"strconv"
 
 	"github.com/Linaro/lite_bootstrap_server/caserver"
 	"github.com/Linaro/lite_bootstrap_server/mtlsserver"
@@ -43,10 +45,23 @@ var startCmd = &cobra.Command{
 a REST API.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		hostname := getHostname()
+		pubport := viper.GetInt("server.pubport")
+		publicurl := viper.GetString("server.publicurl")
+		if publicurl == "" && pubport != 0 {
+			publicurl = "http://" + hostname + ":" + strconv.Itoa(pubport)
+		}
+		caserver.SetPublicURL(publicurl)
+		if err := useCAKey(); err != nil {
+			log.Fatal("CA key: ", err)
+		}
 		mport := viper.GetInt("server.mport")
 		go mtlsserver.StartTCP(hostname, int16(mport))
+		cport := viper.GetInt("server.cport")
+		if cport != 0 {
+			go caserver.StartCoAP(hostname, int16(cport))
+		}
 		port := viper.GetInt("server.port")
-		caserver.Start(hostname, int16(port))
+		caserver.Start(hostname, int16(port), int16(pubport))
 	},
 }
 
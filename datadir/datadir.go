@@ -0,0 +1,36 @@
+// Package datadir locates the files that make up a liteboot instance:
+// the CA database, and the certificates and keys under `certs`.  They
+// are kept together in a data directory, which is the working
+// directory unless the `datadir` setting names another.
+
+package datadir // import "github.com/Linaro/lite_bootstrap_server/datadir"
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/viper"
+)
+
+// Dir returns the data directory.
+func Dir() string {
+	dir := viper.GetString("datadir")
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
+
+// Path returns the path of a file in the data directory.  An absolute
+// name is returned as is.
+func Path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(Dir(), name)
+}
+
+// Certs returns the path of a file in the certs directory, within the
+// data directory.
+func Certs(name string) string {
+	return Path(filepath.Join("certs", name))
+}
@@ -4,10 +4,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"strconv"
+
+	"github.com/Linaro/lite_bootstrap_server/datadir"
+	"github.com/Linaro/lite_bootstrap_server/signer"
 )
 
 func handleConnection(c net.Conn) {
@@ -51,16 +53,15 @@ func handleConnection(c net.Conn) {
 
 // Starts a TCP server with mTLS authentication
 func StartTCP(hostname string, port int16) {
-	// Create a certificate pool with the CA certificate
-	certPool := x509.NewCertPool()
-	caCert, err := ioutil.ReadFile("certs/CA.crt")
+	// Create a certificate pool with the CA certificate, and during a
+	// rollover, the CA it is rolling over to or from
+	certPool, err := signer.TrustPool(datadir.Certs("CA"))
 	if err != nil {
 		log.Fatal(err)
 	}
-	certPool.AppendCertsFromPEM(caCert)
 
 	// Load server key pair
-	cer, err := tls.LoadX509KeyPair("certs/SERVER.crt", "certs/SERVER.key")
+	cer, err := tls.LoadX509KeyPair(datadir.Certs("SERVER.crt"), datadir.Certs("SERVER.key"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -106,8 +107,10 @@ func StartTCP(hostname string, port int16) {
 // ValidatePeer checks the given certificates and makes sure they are
 // appropriate for requests to this TCP server
 func validatePeer(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-	if len(verifiedChains) != 1 {
-		return fmt.Errorf("expecting a single certificate chain")
+	// During a CA rollover, a client sending a cross certificate may
+	// chain to both CAs
+	if len(verifiedChains) == 0 {
+		return fmt.Errorf("expecting a verified certificate chain")
 	}
 
 	// TODO: Validate client certificate UUID is valid in cadb
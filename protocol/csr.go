@@ -1,11 +1,52 @@
 package protocol // github.com/Linaro/lite_bootstrap_server/protocol
 
+import (
+	"errors"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CSRRequest carries a DER encoded CSR.  Devices that started
+// enrollment with an initialisation request also echo the Nonce they
+// were given.  In CBOR this is encoded as an array of one or two
+// byte strings, `[ csr ]` or `[ csr, nonce ]`.
 type CSRRequest struct {
-	_   struct{} `cbor:",toarray"`
-	CSR []byte
+	CSR   []byte
+	Nonce []byte `json:",omitempty"`
+}
+
+func (r CSRRequest) MarshalCBOR() ([]byte, error) {
+	items := [][]byte{r.CSR}
+	if r.Nonce != nil {
+		items = append(items, r.Nonce)
+	}
+	return cbor.Marshal(items)
+}
+
+func (r *CSRRequest) UnmarshalCBOR(data []byte) error {
+	var items [][]byte
+	err := cbor.Unmarshal(data, &items)
+	if err != nil {
+		return err
+	}
+
+	switch len(items) {
+	case 2:
+		r.Nonce = items[1]
+		fallthrough
+	case 1:
+		r.CSR = items[0]
+	default:
+		return errors.New("CSR request must be an array of one or two elements")
+	}
+
+	return nil
 }
 
+// CSRResponse returns the DER encoded certificate, and the DER
+// encoded certificates of the CAs that issued it, nearest first.
 type CSRResponse struct {
-	Status int    `cbor:"1,keyasint"`
-	Cert   []byte `cbor:"2,keyasint"`
+	Status int      `cbor:"1,keyasint"`
+	Cert   []byte   `cbor:"2,keyasint"`
+	Chain  [][]byte `cbor:"3,keyasint,omitempty" json:",omitempty"`
 }
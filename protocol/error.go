@@ -0,0 +1,34 @@
+package protocol // github.com/Linaro/lite_bootstrap_server/protocol
+
+// Codes reported when a request is rejected by the issuance policy,
+// or is otherwise malformed.  InternalError reports a failure of the
+// server itself, such as a database error, whose details are only
+// logged.
+const (
+	PolicyBadSignature        = 1
+	PolicyBadCommonName       = 2
+	PolicyBadOrganization     = 3
+	PolicyBadOrgUnit          = 4
+	PolicyKeyAlgorithm        = 5
+	PolicyCurve               = 6
+	PolicyForbiddenExtension  = 7
+	PolicyTooManySANs         = 8
+	PolicyUnknownProfile      = 9
+	PolicyProfileNotPermitted = 10
+	PolicyKeySize             = 11
+	PolicyEnrollmentLimit     = 12
+	PolicyBadCSR              = 13
+	PolicyBadCertificate      = 14
+	PolicySubjectMismatch     = 15
+	PolicyBadDeviceID         = 16
+	PolicyMissingHWSerial     = 17
+	PolicyAttestationTooLarge = 18
+	InternalError             = 19
+)
+
+// ErrorResponse describes why a request was rejected.  Code is one of
+// the codes above, and Error a human readable description.
+type ErrorResponse struct {
+	Code  int    `cbor:"1,keyasint" json:"code"`
+	Error string `cbor:"2,keyasint" json:"error"`
+}
@@ -0,0 +1,17 @@
+package protocol // github.com/Linaro/lite_bootstrap_server/protocol
+
+// IRRequest is the first contact from a device.  ID is the device
+// UUID that will become the subject CN of its certificate, HWSerial
+// the hardware serial number, and Attestation an optional opaque
+// attestation token.
+type IRRequest struct {
+	ID          string `cbor:"1,keyasint"`
+	HWSerial    string `cbor:"2,keyasint"`
+	Attestation []byte `cbor:"3,keyasint,omitempty" json:",omitempty"`
+}
+
+// IRResponse returns the Nonce the device must echo in its CSRRequest.
+type IRResponse struct {
+	Status int    `cbor:"1,keyasint"`
+	Nonce  []byte `cbor:"2,keyasint"`
+}
@@ -0,0 +1,43 @@
+package protocol // github.com/Linaro/lite_bootstrap_server/protocol
+
+import "math/big"
+
+// Revocation reason codes, from RFC 5280 section 5.3.1.
+const (
+	ReasonUnspecified          = 0
+	ReasonKeyCompromise        = 1
+	ReasonCACompromise         = 2
+	ReasonAffiliationChanged   = 3
+	ReasonSuperseded           = 4
+	ReasonCessationOfOperation = 5
+	ReasonCertificateHold      = 6
+	ReasonRemoveFromCRL        = 8
+	ReasonPrivilegeWithdrawn   = 9
+	ReasonAACompromise         = 10
+)
+
+// KRRRequest asks for the revocation of a certificate.  Sig is needed
+// when the client has not authenticated with a certificate of the
+// same device: it is a signature over SignedData, made with the
+// private key of the certificate being revoked.
+type KRRRequest struct {
+	Serial big.Int `cbor:"1,keyasint"`
+	Reason int     `cbor:"2,keyasint"`
+	Sig    []byte  `cbor:"3,keyasint,omitempty" json:",omitempty"`
+}
+
+// krrSignedPrefix starts the data signed in a key revocation request,
+// so that the signature can't be mistaken for one over anything else.
+const krrSignedPrefix = "liteboot-krr\x00"
+
+// SignedData returns the bytes that Sig is made over: the prefix
+// "liteboot-krr" and a zero byte, then the serial as an unsigned
+// big-endian integer, then the reason as a single byte.
+func (r *KRRRequest) SignedData() []byte {
+	data := append([]byte(krrSignedPrefix), r.Serial.Bytes()...)
+	return append(data, byte(r.Reason))
+}
+
+type KRRResponse struct {
+	Status int `cbor:"1,keyasint"`
+}
@@ -0,0 +1,13 @@
+package protocol // github.com/Linaro/lite_bootstrap_server/protocol
+
+// KURRequest asks for a replacement of a device's current certificate.
+// Cert is the DER encoded certificate being replaced, CSR is the DER
+// encoded request for the new key, and Sig is a signature over the CSR
+// made with the private key of Cert, proving the device still holds
+// it.
+type KURRequest struct {
+	_    struct{} `cbor:",toarray"`
+	Cert []byte
+	CSR  []byte
+	Sig  []byte
+}
@@ -41,6 +41,9 @@ The following files are placed them in the 'certs' folder:
 You can view the content of the certificate via:
 
    $ openssl x509 -in certs/BOOTSTRAP.crt -noout -text
+
+This is a wrapper around 'liteboot bootstrap-cert issue', which can be used
+directly, and can issue certificates for other device classes.
 "
     exit
 fi
@@ -57,7 +60,7 @@ then
 	exit 1
 fi
 
-if [ ! -f certs/CA.key ] || [ ! -f certs/CA.crt ];
+if [ ! -f certs/CA.crt ];
 then
 	echo "CA cert needs to be created first."
 	echo ""
@@ -65,31 +68,9 @@ then
 	exit 1
 fi
 
-mkdir -p certs
+# Build the application.
+go build -o liteboot || exit 1
 
 # This is a simple keypair, where the certificate will be known by the
-# server.
-openssl ecparam -name prime256v1 -genkey -out certs/BOOTSTRAP.key
-
-# Generate the CSR
-openssl req -new -sha256 -key certs/BOOTSTRAP.key \
-	-out certs/BOOTSTRAP.csr \
-	-subj '/O=Linaro, LTD/CN=bootstrap-register-1/OU=LinaroCA Bootstrap Cert'
-
-# Sign it with our CA cert
-openssl x509 -req -sha256 \
-	-CA certs/CA.crt \
-	-CAkey certs/CA.key \
-	-days 3560 \
-	-CAcreateserial \
-	-CAserial certs/CA.srl \
-	-in certs/BOOTSTRAP.csr \
-	-out certs/BOOTSTRAP.crt
-
-rm certs/BOOTSTRAP.csr
-
-# Convert the public and private keys into C code so they can be
-# included into the app.
-sed 's/.*/"&\\r\\n"/' certs/BOOTSTRAP.crt > certs/bootstrap_crt.txt
-openssl ec -in certs/BOOTSTRAP.key -outform DER |
-	xxd -i > certs/bootstrap_key.txt
+# server, and recorded in the CA database.
+./liteboot bootstrap-cert issue
@@ -34,10 +34,14 @@ The following files are placed them in the 'certs' folder:
 
 - certs/CA.crt      Certificate for the CA key used to sign certificates
 - certs/CA.key      Private CA key used to sign certificates (do not share!)
-- certs/CA.srl      Serial number for the CA certificate
+- certs/CA-chain.crt  Certificates above an issuing CA, if one was created
+                    with 'liteboot cakey sign'
 - certs/SERVER.crt  Certificate used during TLS handshakes on the server(s)
 - certs/SERVER.key  Private key used by the TLS server(s) (do not share!)
 - certs/ca_crt.txt  A C string copy of CA.crt for easier reuse elsewhere
+- CADB.db           The CA database, recording the SERVER certificate
+
+This is a wrapper around 'liteboot init', which can be used directly.
 
 You can view the content of the certificates via:
 
@@ -75,8 +79,7 @@ that resolves to this host.
 fi
 
 # Check for previous build artifacts
-if [ -f certs/CA.crt ] || [ -f certs/CA.key ] || \
-   [ -f certs/SERVER.crt ] || [ -f certs/SERVER.key ];
+if [ -f certs/SERVER.crt ] || [ -f certs/SERVER.key ];
 then
 	echo "Server/CA certificates seem to already be present."
 	echo ""
@@ -106,58 +109,14 @@ fi
 
 # Setup the Certificate Authority and server certificates.  In
 # general, this should be run once, to create these initial
-# certificates, for development.
-
-mkdir -p certs
+# certificates, for development.  This is done by 'liteboot init',
+# which uses an issuing CA already created with 'liteboot cakey csr'
+# and 'liteboot cakey sign' as is.
 
 # Build the application.
 go build -o liteboot || exit 1
 
-# The certificate authority requires a key to sign certificates,
-# which can be generated by the app.
-./liteboot cakey generate
-
-# Extract the CA certificate as a C string for inclusion in the demo app.
-sed 's/.*/"&\\r\\n"/' certs/CA.crt > certs/ca_crt.txt
-
-# The CA key is not extracted, as the device should have no access to this.
-
-# The HTTP server requires a private key for TLS.
-openssl ecparam -name secp256r1 -genkey -out certs/SERVER.key
-
-# Generate an X.509 certificate for use by the server.  The clients
-# can verify this by having the CA.crt available, and use this to
-# ensure we are talking to the right server.
-openssl req -new -sha256 -key certs/SERVER.key \
-	-out certs/SERVER.csr \
-	-subj "/O=Linaro, LTD/CN=$HOSTNAME"
-
-# Create a config snippet to add proper extensions to this key.
-echo "subjectKeyIdentifier=hash" > exts$$.ext
-echo "authorityKeyIdentifier=keyid,issuer" >> exts$$.ext
-echo "basicConstraints = critical, CA:FALSE" >> exts$$.ext
-echo "keyUsage = critical, digitalSignature" >> exts$$.ext
-echo "extendedKeyUsage = serverAuth" >> exts$$.ext
-echo "subjectAltName = DNS:$HOSTNAME" >> exts$$.ext
-
-# Sign this with the CA.
-openssl x509 -req -sha256 \
-	-CA certs/CA.crt \
-	-CAkey certs/CA.key \
-	-days 3560 \
-	-CAcreateserial \
-	-CAserial certs/CA.srl \
-	-in certs/SERVER.csr \
-	-out certs/SERVER.crt \
-	-extfile exts$$.ext
-
-rm certs/SERVER.csr
-rm exts$$.ext
+./liteboot init --hostname "$HOSTNAME"
 
 # This certificate can be viewed with
 # openssl x509 -in certs/SERVER.crt -noout -text
-
-# **NOTE**: Certain values are hard-coded in `liteboot` when
-# generating the CA certificate.  This utility may be extended to
-# expose those values in the future, but at the moment the hard-coded
-# values are sufficient for the proof-of-concept nature of this app.
@@ -0,0 +1,137 @@
+package signer // "github.com/Linaro/lite_bootstrap_server/signer"
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// An offline root CA signs an issuing (intermediate) CA, which signs
+// device certificates.  The issuing CA is kept as base.crt and
+// base.key like a root, with the certificates above it in
+// base-chain.crt.
+
+// chainFile returns the name of the chain file for a certificate file.
+func chainFile(certFile string) string {
+	return strings.TrimSuffix(certFile, ".crt") + "-chain.crt"
+}
+
+// loadChain loads a file of PEM certificates.  A missing file is an
+// empty chain.
+func loadChain(name string) ([][]byte, error) {
+	pems, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var chain [][]byte
+	for {
+		var block *pem.Block
+		block, pems = pem.Decode(pems)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("%s: expecting BEGIN CERTIFICATE", name)
+		}
+		chain = append(chain, block.Bytes)
+	}
+
+	return chain, nil
+}
+
+// FullChain returns this certificate followed by the chain above it.
+func (s *SigningCert) FullChain() [][]byte {
+	return append([][]byte{s.CertBin}, s.Chain...)
+}
+
+// NewCACSR builds a CSR for an issuing CA with the given subject,
+// signed by its key.
+func NewCACSR(key crypto.Signer, subject pkix.Name) ([]byte, error) {
+	return x509.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{Subject: subject}, key)
+}
+
+// ExportCSR writes a CSR to a file in PEM format.  May return an
+// error if the file exists.
+func ExportCSR(csrfile string, csr []byte) error {
+	return pemWrite(csrfile, 0644, "CERTIFICATE REQUEST", csr)
+}
+
+// LoadCSR loads a PEM format CSR and checks its signature.
+func LoadCSR(csrfile string) (*x509.CertificateRequest, error) {
+	der, err := loadPem(csrfile, "CERTIFICATE REQUEST")
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+
+	return csr, nil
+}
+
+// SignCA signs the CSR of an issuing CA.  The returned SigningCert
+// holds the new certificate and its chain, but no private key, which
+// stays with the requester.  maxPathLen limits the CAs below the new
+// one, with -1 meaning no limit.
+func (s *SigningCert) SignCA(csr *x509.CertificateRequest, validity time.Duration, maxPathLen int) (*SigningCert, error) {
+	if !s.Cert.IsCA {
+		return nil, fmt.Errorf("Signing certificate is not a CA")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               csr.Subject,
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	if template.NotAfter.After(s.Cert.NotAfter) {
+		template.NotAfter = s.Cert.NotAfter
+	}
+
+	certBin, err := s.SignTemplate(template, csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(certBin)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningCert{
+		CertBin: certBin,
+		Cert:    cert,
+		Chain:   s.FullChain(),
+	}, nil
+}
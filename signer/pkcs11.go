@@ -0,0 +1,336 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11Config selects a key held in a PKCS#11 token, such as an HSM,
+// or SoftHSM for testing.
+type PKCS11Config struct {
+	// Path to the PKCS#11 module, such as
+	// "/usr/lib/softhsm/libsofthsm2.so".
+	Module string
+
+	// The token is found by its label if TokenLabel is set, and
+	// otherwise by its slot number.
+	TokenLabel string
+	Slot       uint
+
+	// User PIN for the token.
+	PIN string
+
+	// CKA_LABEL of the private key, and its matching public key.
+	KeyLabel string
+}
+
+// A PKCS11Key is a crypto.Signer for an ECDSA or RSA private key that
+// stays in a PKCS#11 token.  Signing operations are serialised, as
+// they share a single session.
+type PKCS11Key struct {
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	handle  pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+// OpenPKCS11Key loads the module, logs into the token and finds the
+// key described by `cfg`.
+func OpenPKCS11Key(cfg PKCS11Config) (*PKCS11Key, error) {
+	ctx := pkcs11.New(cfg.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("Unable to load PKCS#11 module %q", cfg.Module)
+	}
+
+	err := ctx.Initialize()
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, err
+	}
+
+	key, err := openPKCS11Key(ctx, cfg)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return key, nil
+}
+
+func openPKCS11Key(ctx *pkcs11.Ctx, cfg PKCS11Config) (*PKCS11Key, error) {
+	slot, err := findSlot(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.Login(session, pkcs11.CKU_USER, cfg.PIN)
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		ctx.CloseSession(session)
+		return nil, fmt.Errorf("PKCS#11 login: %v", err)
+	}
+
+	key := &PKCS11Key{
+		ctx:     ctx,
+		session: session,
+	}
+
+	key.handle, err = key.findObject(pkcs11.CKO_PRIVATE_KEY, cfg.KeyLabel)
+	if err == nil {
+		key.pub, err = key.publicKey(cfg.KeyLabel)
+	}
+	if err != nil {
+		ctx.CloseSession(session)
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// findSlot returns the slot holding the configured token.
+func findSlot(ctx *pkcs11.Ctx, cfg PKCS11Config) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, slot := range slots {
+		if cfg.TokenLabel == "" {
+			if slot == cfg.Slot {
+				return slot, nil
+			}
+			continue
+		}
+
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, err
+		}
+		if info.Label == cfg.TokenLabel {
+			return slot, nil
+		}
+	}
+
+	if cfg.TokenLabel != "" {
+		return 0, fmt.Errorf("PKCS#11 token %q not found", cfg.TokenLabel)
+	}
+	return 0, fmt.Errorf("PKCS#11 slot %d not found", cfg.Slot)
+}
+
+// findObject returns the single object of the given class with the
+// given label.
+func (k *PKCS11Key) findObject(class uint, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	err := k.ctx.FindObjectsInit(k.session, template)
+	if err != nil {
+		return 0, err
+	}
+	objs, _, err := k.ctx.FindObjects(k.session, 2)
+	k.ctx.FindObjectsFinal(k.session)
+	if err != nil {
+		return 0, err
+	}
+
+	kind := "private"
+	if class == pkcs11.CKO_PUBLIC_KEY {
+		kind = "public"
+	}
+	switch len(objs) {
+	case 0:
+		return 0, fmt.Errorf("No PKCS#11 %s key labelled %q", kind, label)
+	case 1:
+		return objs[0], nil
+	default:
+		return 0, fmt.Errorf("More than one PKCS#11 %s key labelled %q", kind, label)
+	}
+}
+
+// publicKey reads the public key object matching the private key.
+func (k *PKCS11Key) publicKey(label string) (crypto.PublicKey, error) {
+	obj, err := k.findObject(pkcs11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := k.ctx.GetAttributeValue(k.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch bytesToUint(attrs[0].Value) {
+	case pkcs11.CKK_EC:
+		attrs, err = k.ctx.GetAttributeValue(k.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ecPublicKey(attrs[0].Value, attrs[1].Value)
+
+	case pkcs11.CKK_RSA:
+		attrs, err = k.ctx.GetAttributeValue(k.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+
+	default:
+		return nil, errors.New("PKCS#11 key must be ECDSA or RSA")
+	}
+}
+
+// The curves a PKCS#11 ECDSA key may use, by their OIDs.
+var pkcs11Curves = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+// ecPublicKey builds an ECDSA public key from the DER encoded
+// CKA_EC_PARAMS and CKA_EC_POINT attributes.
+func ecPublicKey(params, point []byte) (*ecdsa.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	_, err := asn1.Unmarshal(params, &oid)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 EC params: %v", err)
+	}
+	curve, ok := pkcs11Curves[oid.String()]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported PKCS#11 EC curve %s", oid)
+	}
+
+	// The point is normally wrapped in an OCTET STRING, but some
+	// tokens return it bare.
+	var raw []byte
+	if _, err := asn1.Unmarshal(point, &raw); err != nil {
+		raw = point
+	}
+
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, errors.New("Invalid PKCS#11 EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func bytesToUint(b []byte) uint {
+	// Attribute values are in host byte order.
+	var v uint
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint(b[i])
+	}
+	return v
+}
+
+// Public returns the public key, read from the token.
+func (k *PKCS11Key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign signs a digest with the key in the token.  ECDSA signatures
+// are returned in the ASN.1 form used by x509, and RSA keys sign with
+// PKCS#1 v1.5, or PSS when given rsa.PSSOptions.
+func (k *PKCS11Key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mech *pkcs11.Mechanism
+	data := digest
+
+	switch k.pub.(type) {
+	case *ecdsa.PublicKey:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+
+	case *rsa.PublicKey:
+		hash, ok := pkcs11Hashes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported hash %v for PKCS#11 RSA key", opts.HashFunc())
+		}
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			salt := pss.SaltLength
+			if salt == rsa.PSSSaltLengthEqualsHash || salt == rsa.PSSSaltLengthAuto {
+				salt = opts.HashFunc().Size()
+			}
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS,
+				pkcs11.NewPSSParams(hash.mech, hash.mgf, uint(salt)))
+		} else {
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+			data = append(append([]byte{}, hash.prefix...), digest...)
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	err := k.ctx.SignInit(k.session, []*pkcs11.Mechanism{mech}, k.handle)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := k.ctx.Sign(k.session, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := k.pub.(*ecdsa.PublicKey); ok {
+		// PKCS#11 returns r || s.
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
+
+// Close logs out and releases the token.
+func (k *PKCS11Key) Close() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.ctx.Logout(k.session)
+	k.ctx.CloseSession(k.session)
+	k.ctx.Finalize()
+	k.ctx.Destroy()
+}
+
+// pkcs11Hashes gives, for each hash RSA keys may sign with, the
+// PKCS#11 mechanism and MGF for PSS, and the DigestInfo prefix for
+// PKCS#1 v1.5, which the token expects to be included in the data.
+var pkcs11Hashes = map[crypto.Hash]struct {
+	mech, mgf uint
+	prefix    []byte
+}{
+	crypto.SHA1: {pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1,
+		[]byte{0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14}},
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256,
+		[]byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384,
+		[]byte{0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30}},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512,
+		[]byte{0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40}},
+}
@@ -0,0 +1,233 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// softhsmEnv names the environment variable holding the path of the
+// SoftHSM module to test PKCS#11 keys with.  Otherwise, the usual
+// places it is installed are tried, and the tests skipped if it isn't
+// found.
+const softhsmEnv = "LITEBOOT_TEST_SOFTHSM"
+
+var softhsmPaths = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+const (
+	testTokenLabel = "liteboot-test"
+	testSOPIN      = "5678"
+	testPIN        = "1234"
+)
+
+// The DER encoded OID of P-256, for CKA_EC_PARAMS.
+var p256Params = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+
+// newSoftHSMToken initialises a SoftHSM token in a temporary
+// directory, with an ECDSA key labelled "ec" and an RSA key labelled
+// "rsa", and returns the configuration to open them, without the
+// label.
+func newSoftHSMToken(t *testing.T) PKCS11Config {
+	module := os.Getenv(softhsmEnv)
+	if module == "" {
+		for _, path := range softhsmPaths {
+			if fileExists(path) {
+				module = path
+				break
+			}
+		}
+	}
+	if module == "" {
+		t.Skipf("SoftHSM not found; set %s to its module", softhsmEnv)
+	}
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err := ioutil.WriteFile(conf, []byte(fmt.Sprintf(
+		"directories.tokendir = %s\nobjectstore.backend = file\n", dir)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("Unable to load PKCS#11 module %q", module)
+	}
+	defer ctx.Destroy()
+	err = ctx.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no free SoftHSM slot: %v", err)
+	}
+	err = ctx.InitToken(slots[0], testSOPIN, testTokenLabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SoftHSM moves the new token to a slot of its own.
+	cfg := PKCS11Config{
+		Module:     module,
+		TokenLabel: testTokenLabel,
+		PIN:        testPIN,
+	}
+	slot, err := findSlot(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(session)
+
+	err = ctx.Login(session, pkcs11.CKU_SO, testSOPIN)
+	if err == nil {
+		err = ctx.InitPIN(session, testPIN)
+	}
+	if err == nil {
+		err = ctx.Logout(session)
+	}
+	if err == nil {
+		err = ctx.Login(session, pkcs11.CKU_USER, testPIN)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Logout(session)
+
+	generateKeyPair := func(label string, mech uint, pub []*pkcs11.Attribute) {
+		pub = append(pub,
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true))
+		priv := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		}
+		_, _, err := ctx.GenerateKeyPair(session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)}, pub, priv)
+		if err != nil {
+			t.Fatalf("generate %s key: %v", label, err)
+		}
+	}
+	generateKeyPair("ec", pkcs11.CKM_EC_KEY_PAIR_GEN, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, p256Params),
+	})
+	generateKeyPair("rsa", pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+	})
+
+	return cfg
+}
+
+// openTestKey opens a key in the token, closing it when the test
+// finishes.  Only one key is open at a time, as closing a key
+// finalises the module.
+func openTestKey(t *testing.T, cfg PKCS11Config, label string) *PKCS11Key {
+	cfg.KeyLabel = label
+	key, err := OpenPKCS11Key(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(key.Close)
+	return key
+}
+
+// checkSigningCert checks that a self signed CA certificate can be
+// made with the key.
+func checkSigningCert(t *testing.T, key crypto.Signer) {
+	opts := DefaultSigningCertOptions
+	opts.Key = key
+	ca, err := NewSigningCert(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ca.Cert.CheckSignatureFrom(ca.Cert)
+	if err != nil {
+		t.Errorf("self signed certificate: %v", err)
+	}
+}
+
+func TestPKCS11(t *testing.T) {
+	cfg := newSoftHSMToken(t)
+	digest := sha256.Sum256([]byte("liteboot"))
+
+	t.Run("ECDSA", func(t *testing.T) {
+		key := openTestKey(t, cfg, "ec")
+		pub, ok := key.Public().(*ecdsa.PublicKey)
+		if !ok {
+			t.Fatalf("public key is %T; want ECDSA", key.Public())
+		}
+
+		sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			t.Error("ECDSA signature does not verify")
+		}
+		checkSigningCert(t, key)
+	})
+
+	t.Run("RSA", func(t *testing.T) {
+		key := openTestKey(t, cfg, "rsa")
+		pub, ok := key.Public().(*rsa.PublicKey)
+		if !ok {
+			t.Fatalf("public key is %T; want RSA", key.Public())
+		}
+
+		sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+		if err != nil {
+			t.Errorf("PKCS#1 v1.5 signature: %v", err)
+		}
+
+		pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		sig, err = key.Sign(rand.Reader, digest[:], pss)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, pss)
+		if err != nil {
+			t.Errorf("PSS signature: %v", err)
+		}
+
+		checkSigningCert(t, key)
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		cfg.KeyLabel = "missing"
+		_, err := OpenPKCS11Key(cfg)
+		if err == nil {
+			t.Error("OpenPKCS11Key of a missing key succeeded")
+		}
+	})
+}
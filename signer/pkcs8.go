@@ -0,0 +1,232 @@
+package signer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Private keys are encrypted as a PKCS#8 EncryptedPrivateKeyInfo
+// (RFC 5958), using PBES2 (RFC 8018) with scrypt and AES-256-CBC.
+// This is the form written by `openssl pkcs8 -topk8 -scrypt`.  Keys
+// encrypted by openssl with its default of PBKDF2 can also be read.
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// The scrypt cost used for new keys.  This is the openssl default;
+// higher costs exceed the memory openssl allows scrypt by default.
+const (
+	scryptN = 1 << 14
+	scryptR = 8
+	scryptP = 1
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// EncryptKey encrypts a private key with a passphrase, returning the
+// DER of a PKCS#8 EncryptedPrivateKeyInfo.
+func EncryptKey(key crypto.Signer, passphrase []byte) ([]byte, error) {
+	plain, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	dk, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return nil, err
+	}
+	padLen := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append(plain, bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdf, err := asn1.Marshal(scryptParams{
+		Salt:                     salt,
+		CostParameter:            scryptN,
+		BlockSize:                scryptR,
+		ParallelizationParameter: scryptP,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{
+			Algorithm:  oidScrypt,
+			Parameters: asn1.RawValue{FullBytes: kdf},
+		},
+		EncryptionScheme: pkix.AlgorithmIdentifier{
+			Algorithm:  oidAES256CBC,
+			Parameters: asn1.RawValue{FullBytes: ivParam},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBES2,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: data,
+	})
+}
+
+// DecryptKey decrypts the DER of a PKCS#8 EncryptedPrivateKeyInfo with
+// a passphrase, and parses the private key inside.
+func DecryptKey(der []byte, passphrase []byte) (crypto.Signer, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported key encryption %s", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	var keyLen int
+	switch alg := params.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen = 16
+	case alg.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("Unsupported key cipher %s", alg)
+	}
+	var iv []byte
+	_, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("Invalid key cipher IV")
+	}
+
+	dk, err := deriveKey(params.KeyDerivationFunc, passphrase, keyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("Invalid encrypted key length")
+	}
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// A wrong passphrase almost always shows up as bad padding.
+	errPass := errors.New("Unable to decrypt key, wrong passphrase?")
+	padLen := int(plain[len(plain)-1])
+	if padLen == 0 || padLen > aes.BlockSize {
+		return nil, errPass
+	}
+	for _, b := range plain[len(plain)-padLen:] {
+		if int(b) != padLen {
+			return nil, errPass
+		}
+	}
+
+	key, err := parsePKCS8(plain[:len(plain)-padLen])
+	if err != nil {
+		return nil, errPass
+	}
+	return key, nil
+}
+
+// deriveKey derives the encryption key with PBKDF2 or scrypt.
+func deriveKey(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLen int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidScrypt):
+		var p scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, err
+		}
+		return scrypt.Key(passphrase, p.Salt, p.CostParameter,
+			p.BlockSize, p.ParallelizationParameter, keyLen)
+
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var p pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, err
+		}
+		var h func() hash.Hash
+		switch {
+		case p.PRF.Algorithm == nil, p.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			h = sha1.New
+		case p.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		default:
+			return nil, fmt.Errorf("Unsupported PBKDF2 PRF %s", p.PRF.Algorithm)
+		}
+		return pbkdf2.Key(passphrase, p.Salt, p.IterationCount, keyLen, h), nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation %s", kdf.Algorithm)
+	}
+}
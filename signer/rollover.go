@@ -0,0 +1,262 @@
+package signer
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// A CA is rolled over to a new key in stages, tracked by files next to
+// the current CA, base.crt and base.key:
+//
+//   base-next.crt/.key   the successor, which takes over issuance at
+//                        the time in base-next.switch
+//   base-prev.crt/.key   the predecessor, after the rollover is
+//                        completed, still trusted until it expires
+//   X-cross.crt          the certificate of X's key and subject,
+//                        signed by the other CA of the rollover
+//
+// Clients chaining to any of these CAs are accepted.
+//
+// Only a root CA can be rolled over.  An issuing CA is replaced by
+// signing a new one with its root, which devices already trust.
+
+// ErrIssuingCA is returned when a rollover of an issuing CA is
+// requested.
+var ErrIssuingCA = errors.New("Rollover of an issuing CA is not supported; sign a new one with the root instead")
+
+// NextBase returns the base name of the successor of the CA `base`.
+func NextBase(base string) string {
+	return base + "-next"
+}
+
+// PrevBase returns the base name of the predecessor of the CA `base`.
+func PrevBase(base string) string {
+	return base + "-prev"
+}
+
+func crossFile(base string) string {
+	return base + "-cross.crt"
+}
+
+func switchFile(base string) string {
+	return NextBase(base) + ".switch"
+}
+
+// CrossSign issues a CA certificate for the subject and key of
+// `other`, signed by this CA.  The validity of `other` is kept, but
+// limited to that of this CA.
+func (s *SigningCert) CrossSign(other *x509.Certificate) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               other.Subject,
+		NotBefore:             other.NotBefore,
+		NotAfter:              other.NotAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            other.MaxPathLen,
+		MaxPathLenZero:        other.MaxPathLenZero,
+		KeyUsage:              other.KeyUsage,
+	}
+	if template.NotAfter.After(s.Cert.NotAfter) {
+		template.NotAfter = s.Cert.NotAfter
+	}
+
+	return s.SignTemplate(template, other.PublicKey)
+}
+
+// CheckRollover checks that a rollover of the CA `base` can be
+// started, before its successor is generated: no rollover may be in
+// progress, and the CA must not be an issuing CA, with a chain.
+func CheckRollover(base string) error {
+	if fileExists(NextBase(base)+".crt") || fileExists(switchFile(base)) {
+		return fmt.Errorf("A rollover of %s is already in progress", base)
+	}
+	if fileExists(chainFile(base + ".crt")) {
+		return ErrIssuingCA
+	}
+	return nil
+}
+
+// StartRollover writes the successor of the CA `base`, the cross
+// certificates between them, and the time at which the successor
+// takes over issuance.  The successor's key must already be written.
+func StartRollover(base string, next *SigningCert, at time.Time) error {
+	err := CheckRollover(base)
+	if err != nil {
+		return err
+	}
+
+	cur, err := LoadSigningCert(base)
+	if err != nil {
+		return err
+	}
+	if len(cur.Chain) > 0 {
+		return ErrIssuingCA
+	}
+
+	nextCross, err := cur.CrossSign(next.Cert)
+	if err != nil {
+		return err
+	}
+	curCross, err := next.CrossSign(cur.Cert)
+	if err != nil {
+		return err
+	}
+
+	err = next.ExportCert(NextBase(base) + ".crt")
+	if err == nil {
+		err = pemWrite(crossFile(NextBase(base)), 0644, "CERTIFICATE", nextCross)
+	}
+	if err == nil {
+		err = pemWrite(crossFile(base), 0644, "CERTIFICATE", curCross)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(switchFile(base),
+			[]byte(at.UTC().Format(time.RFC3339)+"\n"), 0644)
+	}
+	return err
+}
+
+// RolloverTime returns the time the successor of the CA `base` takes
+// over issuance, if a rollover is in progress.
+func RolloverTime(base string) (time.Time, bool, error) {
+	data, err := ioutil.ReadFile(switchFile(base))
+	if os.IsNotExist(err) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	at, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%s: %v", switchFile(base), err)
+	}
+	return at, true, nil
+}
+
+// IssuerBase returns the base name of the CA that issues certificates
+// now: the successor of `base` once its switch time has passed, and
+// otherwise `base` itself.
+func IssuerBase(base string) (string, error) {
+	at, ok, err := RolloverTime(base)
+	if err != nil {
+		return "", err
+	}
+	if ok && !time.Now().Before(at) {
+		return NextBase(base), nil
+	}
+	return base, nil
+}
+
+// CompleteRollover makes the successor of the CA `base` the current
+// CA, and the current CA its predecessor.  Any earlier predecessor is
+// removed.
+func CompleteRollover(base string) error {
+	at, ok, err := RolloverTime(base)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("No rollover of %s is in progress", base)
+	}
+	if time.Now().Before(at) {
+		return fmt.Errorf("The rollover of %s is scheduled for %s", base, at)
+	}
+
+	// Each of these files moves along with its CA.
+	suffixes := []string{".crt", ".key", ".pass", "-cross.crt"}
+
+	prev := PrevBase(base)
+	next := NextBase(base)
+	for _, suffix := range suffixes {
+		err = os.Remove(prev + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, from := range []string{base, next} {
+		to := prev
+		if from == next {
+			to = base
+		}
+		for _, suffix := range suffixes {
+			err = os.Rename(from+suffix, to+suffix)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return os.Remove(switchFile(base))
+}
+
+// TrustedCerts returns the certificates of the CA `base`, and of its
+// successor and predecessor when they exist and have not expired.
+func TrustedCerts(base string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	now := time.Now()
+
+	for _, b := range []string{base, NextBase(base), PrevBase(base)} {
+		if b != base && !fileExists(b+".crt") {
+			continue
+		}
+
+		cert, err := LoadCert(b + ".crt")
+		if err != nil {
+			return nil, err
+		}
+		if b != base && now.After(cert.NotAfter) {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// TrustPool returns a pool of the certificates from TrustedCerts, for
+// verifying clients.
+func TrustPool(base string) (*x509.CertPool, error) {
+	certs, err := TrustedCerts(base)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// CrossCerts returns the DER cross certificates of a rollover of the
+// CA `base`, in progress or completed.
+func CrossCerts(base string) ([][]byte, error) {
+	var certs [][]byte
+	for _, b := range []string{base, NextBase(base), PrevBase(base)} {
+		chain, err := loadChain(crossFile(b))
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, chain...)
+	}
+	return certs, nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
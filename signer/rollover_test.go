@@ -0,0 +1,89 @@
+package signer
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestIssuingCA writes an issuing CA, signed by a new root, as
+// base.crt and base.key, with its chain.
+func newTestIssuingCA(t *testing.T, base string) {
+	root, err := NewSigningCert(DefaultSigningCertOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GenerateKey(KeyP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := NewCACSR(key, root.Cert.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := root.SignCA(csr, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ca.ExportCert(base + ".crt")
+	if err == nil {
+		err = ExportKey(base+".key", key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartRollover(t *testing.T) {
+	next, err := NewSigningCert(DefaultSigningCertOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now().Add(time.Hour)
+
+	t.Run("root", func(t *testing.T) {
+		base := filepath.Join(t.TempDir(), "CA")
+		ca, err := NewSigningCert(DefaultSigningCertOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ca.Export(base+".crt", base+".key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = StartRollover(base, next, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, _ := RolloverTime(base); !ok {
+			t.Error("no rollover in progress after StartRollover")
+		}
+		err = CheckRollover(base)
+		if err == nil {
+			t.Error("CheckRollover allowed a second rollover")
+		}
+	})
+
+	t.Run("issuing CA", func(t *testing.T) {
+		base := filepath.Join(t.TempDir(), "CA")
+		newTestIssuingCA(t, base)
+
+		if err := CheckRollover(base); err != ErrIssuingCA {
+			t.Errorf("CheckRollover of issuing CA: %v; want %v", err, ErrIssuingCA)
+		}
+		if err := StartRollover(base, next, at); err != ErrIssuingCA {
+			t.Errorf("StartRollover of issuing CA: %v; want %v", err, ErrIssuingCA)
+		}
+		for _, name := range []string{NextBase(base) + ".crt", crossFile(base), switchFile(base)} {
+			if fileExists(name) {
+				t.Errorf("refused rollover wrote %s", filepath.Base(name))
+			}
+		}
+	})
+}
@@ -4,18 +4,24 @@ package signer // "github.com/Linaro/lite_bootstrap_server/signer"
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -24,12 +30,74 @@ import (
 type SigningCert struct {
 	CertBin    []byte
 	Cert       *x509.Certificate
-	PrivateKey *ecdsa.PrivateKey
+	PrivateKey crypto.Signer
+
+	// For an intermediate CA, the DER certificates of the CAs
+	// above it, nearest first, ending with the root.
+	Chain [][]byte
+}
+
+// The key types a signing certificate can be generated with.
+const (
+	KeyP256    = "P-256"
+	KeyP384    = "P-384"
+	KeyRSA3072 = "RSA-3072"
+	KeyEd25519 = "Ed25519"
+)
+
+// SigningCertOptions controls the generation of a new signing
+// certificate.
+type SigningCertOptions struct {
+	// One of the Key constants above.
+	KeyType string
+
+	// Lifetime of the certificate.
+	Validity time.Duration
+
+	// Subject of the certificate.  If the CN is empty, one is
+	// generated from the current time.
+	Subject pkix.Name
+
+	// Limit on the number of intermediate CAs below this one, or
+	// -1 for no limit.
+	MaxPathLen int
+
+	// An existing key, such as one in a PKCS#11 token, to use
+	// instead of generating one of KeyType.
+	Key crypto.Signer
+}
+
+// DefaultSigningCertOptions are the options used by earlier versions,
+// a P-256 key, valid for a year, with no path length limit.
+var DefaultSigningCertOptions = SigningCertOptions{
+	KeyType:  KeyP256,
+	Validity: 365 * 24 * time.Hour,
+	Subject: pkix.Name{
+		Organization: []string{"Linaro, LTD"},
+	},
+	MaxPathLen: -1,
+}
+
+// GenerateKey generates a private key of one of the Key types.
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("Unknown key type %q", keyType)
+	}
 }
 
 // NewSigningCert builds a fresh signing certificate to use as a root
 // certificate.
-func NewSigningCert() (*SigningCert, error) {
+func NewSigningCert(opts SigningCertOptions) (*SigningCert, error) {
 	// The serial number and common name will contain the current
 	// time (in UTC), which, at least for development, should make
 	// these unique.
@@ -41,71 +109,277 @@ func NewSigningCert() (*SigningCert, error) {
 	serial = serial*100 + int64(now.Minute())
 	serial = serial*100 + int64(now.Second())
 
-	cn := "LRC - " + now.Format("20060102030405")
+	subject := opts.Subject
+	if subject.CommonName == "" {
+		subject.CommonName = "LRC - " + now.Format("20060102030405")
+	}
 
 	ca := &x509.Certificate{
 		// TODO: We need to somewhat manage these serial
 		// numbers.  Generating from date/time might work.
 		// Also, the common name will need to be unique.
-		SerialNumber: big.NewInt(serial),
-		Subject: pkix.Name{
-			Organization: []string{"Linaro, LTD"},
-			CommonName:   cn,
-		},
+		SerialNumber:          big.NewInt(serial),
+		Subject:               subject,
 		NotBefore:             now,
-		NotAfter:              now.AddDate(1, 0, 0),
+		NotAfter:              now.Add(opts.Validity),
 		BasicConstraintsValid: true,
 		IsCA:                  true,
+		MaxPathLen:            opts.MaxPathLen,
+		MaxPathLenZero:        opts.MaxPathLen == 0,
 		ExtKeyUsage:           []x509.ExtKeyUsage{},
-		KeyUsage:              x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 	}
 
-	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	privKey := opts.Key
+	if privKey == nil {
+		var err error
+		privKey, err = GenerateKey(opts.KeyType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keyId, err := KeyId(privKey.Public())
 	if err != nil {
 		return nil, err
 	}
 
-	// Determine the KeyID based on the sha1 of the marshalled
-	// public key.
-	pubBytes := elliptic.Marshal(privKey.Curve, privKey.X, privKey.Y)
-	keyId := sha1.Sum(pubBytes)
-
-	ca.SubjectKeyId = keyId[:]
-	ca.AuthorityKeyId = keyId[:]
+	ca.SubjectKeyId = keyId
+	ca.AuthorityKeyId = keyId
 
 	// Self sign this key.
-	cert, err := x509.CreateCertificate(rand.Reader, ca, ca, &privKey.PublicKey, privKey)
+	certBin, err := x509.CreateCertificate(rand.Reader, ca, ca, privKey.Public(), privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(certBin)
 	if err != nil {
 		return nil, err
 	}
 
 	return &SigningCert{
-		CertBin:    cert,
+		CertBin:    certBin,
+		Cert:       cert,
 		PrivateKey: privKey,
 	}, nil
 }
 
+// ParseSubject parses a distinguished name in the slash separated form
+// used by openssl, such as "/O=Linaro, LTD/CN=Device CA".
+func ParseSubject(dn string) (pkix.Name, error) {
+	var name pkix.Name
+
+	if !strings.HasPrefix(dn, "/") {
+		return name, fmt.Errorf("Subject %q must start with '/'", dn)
+	}
+
+	for _, part := range strings.Split(dn[1:], "/") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return name, fmt.Errorf("Invalid subject component %q", part)
+		}
+		switch kv[0] {
+		case "C":
+			name.Country = append(name.Country, kv[1])
+		case "ST":
+			name.Province = append(name.Province, kv[1])
+		case "L":
+			name.Locality = append(name.Locality, kv[1])
+		case "O":
+			name.Organization = append(name.Organization, kv[1])
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, kv[1])
+		case "CN":
+			name.CommonName = kv[1]
+		default:
+			return name, fmt.Errorf("Unsupported subject attribute %q", kv[0])
+		}
+	}
+
+	return name, nil
+}
+
+// KeyId computes the key identifier of a public key, as the SHA-1 hash
+// of the subjectPublicKey bit string (RFC 5280 section 4.2.1.2, method
+// 1).  For ECDSA keys this is the hash of the marshalled point.
+func KeyId(pub interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(der, &spki)
+	if err != nil {
+		return nil, err
+	}
+
+	keyId := sha1.Sum(spki.PublicKey.RightAlign())
+	return keyId[:], nil
+}
+
+// SignTemplate signs a certificate for the public key `pub`, which
+// may be an ECDSA, RSA or Ed25519 key.
 func (s *SigningCert) SignTemplate(template *x509.Certificate, pub interface{}) ([]byte, error) {
-	ecPub, ok := pub.(*ecdsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("Expecting ECDSA key on CSR")
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			return nil, fmt.Errorf("Unsupported ECDSA curve")
+		}
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048, 3072, 4096:
+		default:
+			return nil, fmt.Errorf("Unsupported RSA key size %d", key.N.BitLen())
+		}
+	case ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("Unsupported public key type %T", pub)
 	}
 
 	// Fill in the SubjectKeyId in the template, based on the
 	// public key.  The AuthorityKeyId will be filled in by the
 	// x509 library, provided we're using a recent enough version
 	// of Go.
-	pubBytes := elliptic.Marshal(ecPub.Curve, ecPub.X, ecPub.Y)
-	keyId := sha1.Sum(pubBytes)
+	keyId, err := KeyId(pub)
+	if err != nil {
+		return nil, err
+	}
 
-	template.SubjectKeyId = keyId[:]
+	template.SubjectKeyId = keyId
 
 	return x509.CreateCertificate(rand.Reader, template, s.Cert,
 		pub, s.PrivateKey)
 }
 
+// oidOCSPNoCheck is id-pkix-ocsp-nocheck from RFC 6960, which tells
+// clients not to check the revocation status of an OCSP responder
+// certificate.
+var oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+// NewOCSPSigningCert generates a fresh key, and a certificate signed
+// by this CA delegating OCSP signing to it.  The certificate should
+// be short lived, as it carries the id-pkix-ocsp-nocheck extension.
+func (s *SigningCert) NewOCSPSigningCert(serial *big.Int, validity time.Duration) (*SigningCert, error) {
+	now := time.Now().UTC()
+	return s.newLeafCert(&x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: s.Cert.Subject.Organization,
+			CommonName:   s.Cert.Subject.CommonName + " OCSP Signer",
+		},
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidOCSPNoCheck, Value: asn1.NullBytes},
+		},
+	})
+}
+
+// NewServerCert generates a fresh key, and a TLS server certificate
+// for `hostname` signed by this CA.  The hostname may also be an IP
+// address.
+func (s *SigningCert) NewServerCert(serial *big.Int, hostname string, validity time.Duration) (*SigningCert, error) {
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Linaro, LTD"},
+			CommonName:   hostname,
+		},
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{hostname}
+	}
+
+	return s.newLeafCert(template)
+}
+
+// NewBootstrapCert generates a fresh key, and a TLS client
+// certificate signed by this CA that a class of devices uses to
+// enroll.  The subject OU names the class.
+func (s *SigningCert) NewBootstrapCert(serial *big.Int, subject pkix.Name, validity time.Duration) (*SigningCert, error) {
+	now := time.Now().UTC()
+	return s.newLeafCert(&x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// newLeafCert generates a fresh P-256 key, and signs the template for
+// it with this CA.
+func (s *SigningCert) newLeafCert(template *x509.Certificate) (*SigningCert, error) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	certBin, err := s.SignTemplate(template, &privKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(certBin)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningCert{
+		CertBin:    certBin,
+		Cert:       cert,
+		PrivateKey: privKey,
+	}, nil
+}
+
+// SignCRL builds and signs a CRL listing the given revoked
+// certificates.  The CA certificate must have the cRLSign key usage.
+func (s *SigningCert) SignCRL(revoked []x509.RevocationListEntry, number *big.Int, thisUpdate, nextUpdate time.Time) ([]byte, error) {
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: revoked,
+		Number:                    number,
+		ThisUpdate:                thisUpdate,
+		NextUpdate:                nextUpdate,
+	}
+
+	return x509.CreateRevocationList(rand.Reader, template, s.Cert, s.PrivateKey)
+}
+
+// keys holds the private keys that are not kept in files, such as
+// keys in a PKCS#11 token, by the base name of their certificate.
+var keys = map[string]crypto.Signer{}
+
+// UseKey makes LoadSigningCert use `key` for the signing certificate
+// `base`, rather than reading base.key.  This should be called before
+// any certificates are loaded.
+func UseKey(base string, key crypto.Signer) {
+	keys[base] = key
+}
+
 // LoadSigningCert loads a signing certificate from a pair of files
-// base.crt, and base.key.
+// base.crt, and base.key, or from base.crt and the key given to
+// UseKey.  For an intermediate CA, the certificates of the CAs above
+// it are loaded from base-chain.crt.
 func LoadSigningCert(base string) (*SigningCert, error) {
 	// TODO: Load cert and key
 
@@ -119,12 +393,17 @@ func LoadSigningCert(base string) (*SigningCert, error) {
 		return nil, err
 	}
 
-	keyBin, err := loadPem(base+".key", "EC PRIVATE KEY")
+	key, ok := keys[base]
+	if ok {
+		err = checkKeyMatches(caCert, key)
+	} else {
+		key, err = LoadKey(base+".key", nil)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	key, err := x509.ParseECPrivateKey(keyBin)
+	chain, err := loadChain(chainFile(base + ".crt"))
 	if err != nil {
 		return nil, err
 	}
@@ -133,20 +412,114 @@ func LoadSigningCert(base string) (*SigningCert, error) {
 		CertBin:    certBin,
 		Cert:       caCert,
 		PrivateKey: key,
+		Chain:      chain,
 	}, nil
 }
 
-// loadPem loads a file of an expected type in PEM form.
-func loadPem(name, expectedType string) ([]byte, error) {
+// LoadCert loads a certificate from a file in PEM form.
+func LoadCert(name string) (*x509.Certificate, error) {
+	der, err := loadPem(name, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// checkKeyMatches checks that `key` is the private key for `cert`.
+func checkKeyMatches(cert *x509.Certificate, key crypto.Signer) error {
+	certId, err := KeyId(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	keyId, err := KeyId(key.Public())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(certId, keyId) {
+		return errors.New("Key does not match the certificate")
+	}
+	return nil
+}
+
+// ErrKeyEncrypted is returned when loading an encrypted key that has
+// not been unlocked with UnlockKey.
+var ErrKeyEncrypted = errors.New("Key is encrypted, and has not been unlocked")
+
+// UnlockKey loads the private key base.key, decrypting it with the
+// passphrase if it is encrypted, and arranges for LoadSigningCert to
+// use it from then on, so the key is only decrypted once.
+func UnlockKey(base string, passphrase []byte) error {
+	key, err := LoadKey(base+".key", passphrase)
+	if err != nil {
+		return err
+	}
+	UseKey(base, key)
+	return nil
+}
+
+// LoadKey loads a private key from a PEM file.  This may be a PKCS#8
+// key of any supported type, an encrypted PKCS#8 key if a passphrase
+// is given, or an older "EC PRIVATE KEY".
+func LoadKey(name string, passphrase []byte) (crypto.Signer, error) {
 	pems, err := ioutil.ReadFile(name)
 	if err != nil {
 		return nil, err
 	}
 
 	bin, rest := pem.Decode(pems)
+	if bin == nil {
+		return nil, fmt.Errorf("%s: no PEM data", name)
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("Extraneous file data after key")
+	}
+
+	switch bin.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(bin.Bytes)
+	case "PRIVATE KEY":
+		return parsePKCS8(bin.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == nil {
+			return nil, ErrKeyEncrypted
+		}
+		return DecryptKey(bin.Bytes, passphrase)
+	default:
+		return nil, fmt.Errorf("Expecting BEGIN PRIVATE KEY")
+	}
+}
+
+// parsePKCS8 parses an unencrypted PKCS#8 private key of one of the
+// supported types.
+func parsePKCS8(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
 	if err != nil {
 		return nil, err
 	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("Unsupported private key type %T", key)
+	}
+}
+
+// loadPem loads a file of an expected type in PEM form.
+func loadPem(name, expectedType string) ([]byte, error) {
+	pems, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	bin, rest := pem.Decode(pems)
+	if bin == nil {
+		return nil, fmt.Errorf("%s: no PEM data", name)
+	}
 	if bin.Type != expectedType {
 		return nil, fmt.Errorf("Expecting BEGIN %s", expectedType)
 	}
@@ -160,37 +533,71 @@ func loadPem(name, expectedType string) ([]byte, error) {
 // Export writes the certificate and the signing key to files in PEM
 // format.  May return an error if the files exist.
 func (s *SigningCert) Export(cafile, keyfile string) error {
-	err := pemWrite(cafile, "CERTIFICATE", s.CertBin)
+	err := s.ExportCert(cafile)
+	if err != nil {
+		return err
+	}
+
+	return ExportKey(keyfile, s.PrivateKey)
+}
+
+// ExportCert writes the certificate to a file in PEM format, and any
+// chain above it to the matching -chain.crt file.  May return an
+// error if the files exist.
+func (s *SigningCert) ExportCert(cafile string) error {
+	err := pemWrite(cafile, 0644, "CERTIFICATE", s.CertBin)
 	if err != nil {
 		return err
 	}
 
-	priv, err := x509.MarshalECPrivateKey(s.PrivateKey)
+	if len(s.Chain) > 0 {
+		err = pemWrite(chainFile(cafile), 0644, "CERTIFICATE", s.Chain...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExportKey writes a private key to a file in PKCS#8 PEM format.  May
+// return an error if the file exists.
+func ExportKey(keyfile string, key crypto.Signer) error {
+	priv, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
 		return err
 	}
 
-	err = pemWrite(keyfile, "EC PRIVATE KEY", priv)
+	return pemWrite(keyfile, 0600, "PRIVATE KEY", priv)
+}
+
+// ExportEncryptedKey writes a private key to a file in encrypted
+// PKCS#8 PEM format.  May return an error if the file exists.
+func ExportEncryptedKey(keyfile string, key crypto.Signer, passphrase []byte) error {
+	der, err := EncryptKey(key, passphrase)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return pemWrite(keyfile, 0600, "ENCRYPTED PRIVATE KEY", der)
 }
 
-// pemWrite writes the given block of data to a pem file of the given
-// kind.
-func pemWrite(path string, kind string, data []byte) error {
+// pemWrite writes the given blocks of data to a pem file of the given
+// kind, with the given permissions.
+func pemWrite(path string, perm os.FileMode, kind string, data ...[]byte) error {
 	var buf bytes.Buffer
-	pem.Encode(&buf, &pem.Block{
-		Type:  kind,
-		Bytes: data,
-	})
+	for _, block := range data {
+		pem.Encode(&buf, &pem.Block{
+			Type:  kind,
+			Bytes: block,
+		})
+	}
 
-	fd, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
 	if err != nil {
 		return err
 	}
+	defer fd.Close()
 
 	_, err = fd.Write(buf.Bytes())
 	return err
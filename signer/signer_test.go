@@ -0,0 +1,54 @@
+package signer
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPem(t *testing.T) {
+	ca, err := NewSigningCert(DefaultSigningCertOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	crt := filepath.Join(dir, "CA.crt")
+	err = ca.Export(crt, filepath.Join(dir, "CA.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := loadPem(crt, "CERTIFICATE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(der) != string(ca.CertBin) {
+		t.Error("loadPem returned a different certificate")
+	}
+
+	for _, test := range []struct {
+		name, data, want string
+	}{
+		{"empty", "", "no PEM data"},
+		{"not PEM", "certificate\n", "no PEM data"},
+		{"DER", string(ca.CertBin), "no PEM data"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			name := filepath.Join(dir, strings.ReplaceAll(test.name, " ", "_"))
+			err := ioutil.WriteFile(name, []byte(test.data), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = loadPem(name, "CERTIFICATE")
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("loadPem: %v; want %q", err, test.want)
+			}
+		})
+	}
+
+	_, err = loadPem(filepath.Join(dir, "CA.key"), "CERTIFICATE")
+	if err == nil || !strings.Contains(err.Error(), "Expecting BEGIN CERTIFICATE") {
+		t.Errorf("loadPem of a key: %v; want \"Expecting BEGIN CERTIFICATE\"", err)
+	}
+}
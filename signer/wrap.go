@@ -0,0 +1,130 @@
+package signer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// A KeyWrapper protects the passphrase of an encrypted key with a key
+// encryption key held elsewhere, in the manner of a cloud KMS.  A
+// random passphrase is generated for the key, and stored wrapped in
+// base.pass, next to base.key.
+type KeyWrapper interface {
+	Wrap(plain []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// keyWrappers opens key wrappers, by the scheme of their URI.
+var keyWrappers = map[string]func(arg string) (KeyWrapper, error){
+	"file": openFileWrapper,
+}
+
+// RegisterKeyWrapper makes a key wrapper available under a URI scheme,
+// such as "kms".  `open` is given the rest of the URI.
+func RegisterKeyWrapper(scheme string, open func(arg string) (KeyWrapper, error)) {
+	keyWrappers[scheme] = open
+}
+
+// OpenKeyWrapper opens the key wrapper named by a URI, such as
+// "file:/etc/liteboot/kek".
+func OpenKeyWrapper(uri string) (KeyWrapper, error) {
+	parts := strings.SplitN(uri, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid key wrapper %q", uri)
+	}
+
+	open, ok := keyWrappers[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("Unknown key wrapper %q", parts[0])
+	}
+	return open(parts[1])
+}
+
+// passFile returns the name of the wrapped passphrase for base.key.
+func passFile(base string) string {
+	return base + ".pass"
+}
+
+// NewWrappedPassphrase generates a random passphrase for base.key, and
+// writes it to base.pass, wrapped by `w`.
+func NewWrappedPassphrase(w KeyWrapper, base string) ([]byte, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	passphrase := []byte(hex.EncodeToString(raw))
+
+	wrapped, err := w.Wrap(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pemWrite(passFile(base), 0600, "WRAPPED PASSPHRASE", wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return passphrase, nil
+}
+
+// UnwrapPassphrase reads the passphrase for base.key from base.pass,
+// and unwraps it with `w`.
+func UnwrapPassphrase(w KeyWrapper, base string) ([]byte, error) {
+	wrapped, err := loadPem(passFile(base), "WRAPPED PASSPHRASE")
+	if err != nil {
+		return nil, err
+	}
+	return w.Unwrap(wrapped)
+}
+
+// fileWrapper is a local stand-in for a KMS, wrapping with AES-256-GCM
+// under a 32 byte key read from a file.  The wrapped form is the nonce
+// followed by the sealed data.
+type fileWrapper struct {
+	aead cipher.AEAD
+}
+
+func openFileWrapper(name string) (KeyWrapper, error) {
+	kek, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(kek) != 32 {
+		return nil, fmt.Errorf("%s: key encryption key must be 32 bytes", name)
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWrapper{aead: aead}, nil
+}
+
+func (f *fileWrapper) Wrap(plain []byte) ([]byte, error) {
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return f.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (f *fileWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	n := f.aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, errors.New("Wrapped passphrase is too short")
+	}
+	plain, err := f.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil {
+		return nil, errors.New("Unable to unwrap passphrase, wrong key?")
+	}
+	return plain, nil
+}